@@ -0,0 +1,133 @@
+package fdfs_client
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AntiSteal makes and checks the anti steal tokens of the FastDFS http
+// module. The token of a file is md5(filename + secret_key + ts) in hex, the
+// filename is without group name and ts is the unix time the url is made at.
+// URLs carry it as ?token={token}&ts={ts}.
+type AntiSteal struct {
+	SecretKey string
+	// TokenTTL is how long a token is accepted after it is made, 0 means
+	// forever
+	TokenTTL time.Duration
+	// TokenCheckFail, if set, is a local file answered instead of 403 when
+	// a token is rejected
+	TokenCheckFail string
+}
+
+// NewAntiStealFromConfig returns the anti steal settings of conf, or nil if
+// http.anti_steal.check_token is off
+func NewAntiStealFromConfig(conf *Config) *AntiSteal {
+	if !conf.AntiStealCheckToken {
+		return nil
+	}
+	return &AntiSteal{
+		SecretKey:      conf.AntiStealSecretKey,
+		TokenTTL:       conf.AntiStealTokenTTL,
+		TokenCheckFail: conf.AntiStealTokenCheckFail,
+	}
+}
+
+// Token is fdfs_http_gen_token of remoteFilename, without group name, made at ts
+func (this *AntiSteal) Token(remoteFilename string, ts int64) string {
+	sum := md5.Sum([]byte(remoteFilename + this.SecretKey + strconv.FormatInt(ts, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckToken is fdfs_http_check_token, it returns an ErrPermission error if
+// the token is wrong or expired
+func (this *AntiSteal) CheckToken(remoteFilename string, ts int64, token string) error {
+	if this.TokenTTL > 0 && time.Now().Unix()-ts > int64(this.TokenTTL/time.Second) {
+		return fmt.Errorf("%w: token of %s is expired", ErrPermission, remoteFilename)
+	}
+	expect := this.Token(remoteFilename, ts)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expect)) != 1 {
+		return fmt.Errorf("%w: invalid token of %s", ErrPermission, remoteFilename)
+	}
+	return nil
+}
+
+// SignUrl appends the token and ts of fileId, made now, to the url of the file
+func (this *AntiSteal) SignUrl(rawUrl string, fileId *FileId) string {
+	ts := time.Now().Unix()
+	sep := "?"
+	if strings.Contains(rawUrl, "?") {
+		sep = "&"
+	}
+	return rawUrl + sep + "token=" + this.Token(fileId.FileName, ts) + "&ts=" + strconv.FormatInt(ts, 10)
+}
+
+// Handler checks the token of the requests of /{group}/{filename} before they
+// are passed to next
+func (this *AntiSteal) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := this.CheckRequest(r); err != nil {
+			if this.TokenCheckFail != "" {
+				http.ServeFile(w, r, this.TokenCheckFail)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CheckRequest checks the token and ts parameters of a request of
+// /{group}/{filename}
+func (this *AntiSteal) CheckRequest(r *http.Request) error {
+	fid, err := NewFileIdFromStr(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	ts, err := strconv.ParseInt(query.Get("ts"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid ts %q", ErrPermission, query.Get("ts"))
+	}
+	return this.CheckToken(fid.FileName, ts, query.Get("token"))
+}
+
+// UrlBuilder makes the download urls of files, http://host[:port]/{group}/{filename}
+type UrlBuilder struct {
+	// BaseUrls is the base url of a group name or of a storage ip address,
+	// like "http://img1.example.com". The storage of a file is the source
+	// storage in its filename, it is tried before the group.
+	BaseUrls       map[string]string
+	DefaultBaseUrl string
+	// AntiSteal signs the urls if it is not nil
+	AntiSteal *AntiSteal
+}
+
+// Url returns the url of remoteFileId
+func (this *UrlBuilder) Url(remoteFileId string) (string, error) {
+	fid, err := NewFileIdFromStr(remoteFileId)
+	if err != nil {
+		return "", err
+	}
+	base := this.DefaultBaseUrl
+	if info, err := fid.Decode(); err == nil && this.BaseUrls[info.SourceIpAddr] != "" {
+		base = this.BaseUrls[info.SourceIpAddr]
+	} else if this.BaseUrls[fid.GroupName] != "" {
+		base = this.BaseUrls[fid.GroupName]
+	}
+	if base == "" {
+		return "", fmt.Errorf("%w: no base url of %s", ErrInvalidArgument, remoteFileId)
+	}
+	u := strings.TrimSuffix(base, "/") + "/" + fid.GroupName + "/" + (&url.URL{Path: fid.FileName}).EscapedPath()
+	if this.AntiSteal != nil {
+		u = this.AntiSteal.SignUrl(u, fid)
+	}
+	return u, nil
+}
@@ -0,0 +1,81 @@
+package fdfs_client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAntiStealToken(t *testing.T) {
+	as := &AntiSteal{SecretKey: "FastDFS1234567890", TokenTTL: 900 * time.Second}
+	filename := "M00/00/00/wKgBF1mZ2T2AEV9RAAAADd3mMDs123.jpg"
+	// md5 of filename + secret key + ts, as fdfs_http_gen_token makes it
+	if token := as.Token(filename, 1503236400); token != "2f342ee164831186a641ef734cfae6aa" {
+		t.Fatalf("token is %s", token)
+	}
+
+	now := time.Now().Unix()
+	if err := as.CheckToken(filename, now, as.Token(filename, now)); err != nil {
+		t.Fatal("CheckToken error:", err)
+	}
+	if err := as.CheckToken(filename, 1503236400, "2f342ee164831186a641ef734cfae6aa"); err == nil {
+		t.Fatal("expired token is accepted")
+	}
+	if err := as.CheckToken(filename, now, as.Token(filename+"x", now)); err == nil {
+		t.Fatal("token of another file is accepted")
+	}
+}
+
+func TestUrlBuilder(t *testing.T) {
+	as := &AntiSteal{SecretKey: "secret", TokenTTL: time.Minute}
+	builder := &UrlBuilder{
+		BaseUrls: map[string]string{
+			"group2":      "http://img2.example.com/",
+			"192.168.1.1": "http://storage1.example.com",
+		},
+		DefaultBaseUrl: "http://img.example.com",
+		AntiSteal:      as,
+	}
+	fromStorage1 := "group1/" + makeFilename([4]byte{192, 168, 1, 1}, 1503236400, 10, 0, nil, ".jpg")
+	tests := []struct {
+		fileId string
+		base   string
+	}{
+		{"group1/M00/00/00/test.jpg", "http://img.example.com/"},
+		{"group2/M00/00/00/test.jpg", "http://img2.example.com/"},
+		{fromStorage1, "http://storage1.example.com/"},
+	}
+	handler := as.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		u, err := builder.Url(tt.fileId)
+		if err != nil {
+			t.Fatal("Url error:", err)
+		}
+		if !strings.HasPrefix(u, tt.base+tt.fileId+"?token=") {
+			t.Fatalf("url of %s is %s", tt.fileId, u)
+		}
+		parsed, _ := url.Parse(u)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", parsed.RequestURI(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("signed url %s is rejected with %d", u, rec.Code)
+		}
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, uri := range []string{
+		"/group1/M00/00/00/test.jpg",
+		"/group1/M00/00/00/test.jpg?ts=" + ts + "&token=" + as.Token("M00/00/00/other.jpg", time.Now().Unix()),
+		"/group1/M00/00/00/test.jpg?ts=100&token=" + as.Token("M00/00/00/test.jpg", 100),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", uri, nil))
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("%s answers %d, expect 403", uri, rec.Code)
+		}
+	}
+}
@@ -1,158 +1,437 @@
 package fdfs_client
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 type FdfsClient struct {
 	ConnPool *ConnectionPool
+	// StoragePool is optional, storage connections are not reused if it is nil
+	StoragePool *StoragePool
+	// UploadFailover makes uploads try every writable storage of the group
+	// in turn, instead of failing with the single storage the tracker picks.
+	// Slave files always go to the storage of their master file.
+	UploadFailover bool
+	// FailoverBufferSize is the max size of a non seekable upload input that is
+	// buffered in memory, so that it can be sent again to the next storage
+	FailoverBufferSize int64
+	// DownloadFailover makes downloads ask the tracker for every replica and
+	// continue on the next one when a storage fails
+	DownloadFailover bool
+	// HedgeDelay, if positive, starts a download on the next replica whenever
+	// the current attempts took longer than HedgeDelay, the first complete
+	// response wins. Hedged responses are buffered in memory.
+	HedgeDelay time.Duration
+	// Instrumentation, if not nil, is told about every request, set it with
+	// SetInstrumentation to get the events of the pools too
+	Instrumentation Instrumentation
 	//	timeout  int
 }
 
-func (this *FdfsClient) UploadByFilename(filename string) (remoteFileId string, e error) {
-	if _, err := os.Stat(filename); err != nil {
-		return "", errors.New(err.Error() + "(uploading)")
+// NewFdfsClient creates a client from a FastDFS client.conf
+func NewFdfsClient(confFile string) (*FdfsClient, error) {
+	conf, err := LoadConfig(confFile)
+	if err != nil {
+		return nil, err
 	}
+	return NewFdfsClientFromConfig(conf)
+}
 
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageStoreWithoutGroup()
+func NewFdfsClientFromConfig(conf *Config) (*FdfsClient, error) {
+	pool, err := newConnectionPool(conf.TrackerServers, conf.MinConns, conf.MaxConns,
+		conf.ConnectTimeout, conf.NetworkTimeout)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	fid, e := store.UploadByFilename(filename)
-	if e != nil {
-		return "", e
+	storagePool, err := NewStoragePool(conf.StorageMaxIdle, conf.StorageMaxConns)
+	if err != nil {
+		pool.Close()
+		return nil, err
 	}
-	return fid.GetFileIdStr(), nil
+	storagePool.ConnectTimeout = conf.ConnectTimeout
+	storagePool.NetworkTimeout = conf.NetworkTimeout
+
+	testOnGet := conf.PoolTestOnGet || conf.PoolHealthCheckInterval <= 0
+	pool.IdleTimeout = conf.PoolIdleTimeout
+	pool.MaxLifetime = conf.PoolMaxLifetime
+	pool.HealthCheckInterval = conf.PoolHealthCheckInterval
+	pool.TestOnGet = testOnGet
+	pool.Selector = conf.TrackerSelector
+	storagePool.IdleTimeout = conf.PoolIdleTimeout
+	storagePool.MaxLifetime = conf.PoolMaxLifetime
+	storagePool.HealthCheckInterval = conf.PoolHealthCheckInterval
+	storagePool.TestOnGet = testOnGet
+	if err = pool.fill(); err != nil {
+		pool.Close()
+		storagePool.Close()
+		return nil, err
+	}
+	return &FdfsClient{ConnPool: pool, StoragePool: storagePool}, nil
 }
 
-func (this *FdfsClient) UploadByBuffer(fileBuffer []byte, fileExtName string) (remoteFileId string, e error) {
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageStoreWithoutGroup()
-	if err != nil {
-		return "", err
+func (this *FdfsClient) Close() {
+	this.ConnPool.Close()
+	if this.StoragePool != nil {
+		this.StoragePool.Close()
 	}
-	fid, e := store.UploadByBuffer(fileBuffer, fileExtName)
-	if e != nil {
-		return "", e
+}
+
+// SetInstrumentation sets the Instrumentation of the client and of its pools,
+// it must be called before the client is used
+func (this *FdfsClient) SetInstrumentation(inst Instrumentation) {
+	this.Instrumentation = inst
+	this.ConnPool.SetInstrumentation(inst)
+	if this.StoragePool != nil {
+		this.StoragePool.SetInstrumentation(inst)
 	}
-	return fid.GetFileIdStr(), nil
+}
+
+func (this *FdfsClient) trackerClient() *TrackerClient {
+	return &TrackerClient{Pool: this.ConnPool, StoragePool: this.StoragePool, Instrumentation: this.Instrumentation}
+}
+
+func (this *FdfsClient) UploadByFilename(filename string) (remoteFileId string, e error) {
+	return this.UploadByFilenameContext(context.Background(), filename)
+}
+
+func (this *FdfsClient) UploadByFilenameContext(ctx context.Context, filename string) (remoteFileId string, e error) {
+	if _, err := os.Stat(filename); err != nil {
+		return "", fmt.Errorf("%w(uploading)", err)
+	}
+
+	return this.upload(ctx, nil, 0, func(store *StorageClient, _ io.Reader) (*FileId, error) {
+		return store.UploadByFilenameContext(ctx, filename)
+	})
+}
+
+func (this *FdfsClient) UploadByBuffer(fileBuffer []byte, fileExtName string) (remoteFileId string, e error) {
+	return this.UploadByBufferContext(context.Background(), fileBuffer, fileExtName)
+}
+
+func (this *FdfsClient) UploadByBufferContext(ctx context.Context, fileBuffer []byte, fileExtName string) (remoteFileId string, e error) {
+	return this.upload(ctx, nil, 0, func(store *StorageClient, _ io.Reader) (*FileId, error) {
+		return store.UploadByBufferContext(ctx, fileBuffer, fileExtName)
+	})
 }
 
 func (this *FdfsClient) UploadByReader(reader io.Reader, size int64, fileExtName string) (remoteFileId string, e error) {
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageStoreWithoutGroup()
+	return this.UploadByReaderContext(context.Background(), reader, size, fileExtName)
+}
+
+func (this *FdfsClient) UploadByReaderContext(ctx context.Context, reader io.Reader, size int64, fileExtName string) (remoteFileId string, e error) {
+	return this.upload(ctx, reader, size, func(store *StorageClient, input io.Reader) (*FileId, error) {
+		return store.UploadByReaderContext(ctx, input, size, fileExtName)
+	})
+}
+
+func (this *FdfsClient) UploadSlaveByFilename(filename, masterFileId, prefixName string) (remoteFileId string, e error) {
+	return this.UploadSlaveByFilenameContext(context.Background(), filename, masterFileId, prefixName)
+}
+
+func (this *FdfsClient) UploadSlaveByFilenameContext(ctx context.Context, filename, masterFileId, prefixName string) (remoteFileId string, e error) {
+	if _, err := os.Stat(filename); err != nil {
+		return "", fmt.Errorf("%w(uploading)", err)
+	}
+
+	return this.uploadSlave(ctx, masterFileId, func(store *StorageClient, masterFilename string) (*FileId, error) {
+		return store.UploadSlaveByFilenameContext(ctx, filename, prefixName, masterFilename)
+	})
+}
+
+func (this *FdfsClient) UploadSlaveByBuffer(fileBuffer []byte, masterFileId, prefixName, fileExtName string) (remoteFileId string, e error) {
+	return this.UploadSlaveByBufferContext(context.Background(), fileBuffer, masterFileId, prefixName, fileExtName)
+}
+
+func (this *FdfsClient) UploadSlaveByBufferContext(ctx context.Context, fileBuffer []byte, masterFileId, prefixName, fileExtName string) (remoteFileId string, e error) {
+	return this.uploadSlave(ctx, masterFileId, func(store *StorageClient, masterFilename string) (*FileId, error) {
+		return store.UploadSlaveByBufferContext(ctx, fileBuffer, prefixName, masterFilename, fileExtName)
+	})
+}
+
+func (this *FdfsClient) UploadSlaveByReader(reader io.Reader, size int64, masterFileId, prefixName, fileExtName string) (remoteFileId string, e error) {
+	return this.UploadSlaveByReaderContext(context.Background(), reader, size, masterFileId, prefixName, fileExtName)
+}
+
+func (this *FdfsClient) UploadSlaveByReaderContext(ctx context.Context, reader io.Reader, size int64, masterFileId, prefixName, fileExtName string) (remoteFileId string, e error) {
+	return this.uploadSlave(ctx, masterFileId, func(store *StorageClient, masterFilename string) (*FileId, error) {
+		return store.UploadSlaveByReaderContext(ctx, reader, size, prefixName, masterFilename, fileExtName)
+	})
+}
+
+// uploadSlave runs fn on the source storage of the master file, a slave file
+// must be stored next to its master so it never fails over to another storage
+func (this *FdfsClient) uploadSlave(ctx context.Context, masterFileId string,
+	fn func(store *StorageClient, masterFilename string) (*FileId, error)) (string, error) {
+	masterFid, store, err := this.queryUpdateStorage(ctx, masterFileId)
 	if err != nil {
 		return "", err
 	}
-	fid, e := store.UploadByReader(reader, size, fileExtName)
-	if e != nil {
-		return "", e
+	fid, err := fn(store, masterFid.FileName)
+	if err != nil {
+		return "", err
 	}
 	return fid.GetFileIdStr(), nil
 }
 
-func (this *FdfsClient) UploadSlaveByFilename(filename, masterFileId, prefixName string) (remoteFileId string, e error) {
+func (this *FdfsClient) UploadAppenderByFilename(filename string) (remoteFileId string, e error) {
+	return this.UploadAppenderByFilenameContext(context.Background(), filename)
+}
+
+func (this *FdfsClient) UploadAppenderByFilenameContext(ctx context.Context, filename string) (remoteFileId string, e error) {
 	if _, err := os.Stat(filename); err != nil {
-		return "", errors.New(err.Error() + "(uploading)")
+		return "", fmt.Errorf("%w(uploading)", err)
 	}
 
-	masterFid, err := NewFileIdFromStr(masterFileId)
+	return this.upload(ctx, nil, 0, func(store *StorageClient, _ io.Reader) (*FileId, error) {
+		return store.UploadAppenderByFilenameContext(ctx, filename)
+	})
+}
+
+func (this *FdfsClient) UploadAppenderByBuffer(fileBuffer []byte, fileExtName string) (remoteFileId string, e error) {
+	return this.UploadAppenderByBufferContext(context.Background(), fileBuffer, fileExtName)
+}
+
+func (this *FdfsClient) UploadAppenderByBufferContext(ctx context.Context, fileBuffer []byte, fileExtName string) (remoteFileId string, e error) {
+	return this.upload(ctx, nil, 0, func(store *StorageClient, _ io.Reader) (*FileId, error) {
+		return store.UploadAppenderByBufferContext(ctx, fileBuffer, fileExtName)
+	})
+}
+
+func (this *FdfsClient) UploadAppenderByReader(reader io.Reader, size int64, fileExtName string) (remoteFileId string, e error) {
+	return this.UploadAppenderByReaderContext(context.Background(), reader, size, fileExtName)
+}
+
+func (this *FdfsClient) UploadAppenderByReaderContext(ctx context.Context, reader io.Reader, size int64, fileExtName string) (remoteFileId string, e error) {
+	return this.upload(ctx, reader, size, func(store *StorageClient, input io.Reader) (*FileId, error) {
+		return store.UploadAppenderByReaderContext(ctx, input, size, fileExtName)
+	})
+}
+
+func (this *FdfsClient) AppendByBuffer(appenderFileId string, fileBuffer []byte) error {
+	return this.AppendByBufferContext(context.Background(), appenderFileId, fileBuffer)
+}
+
+func (this *FdfsClient) AppendByBufferContext(ctx context.Context, appenderFileId string, fileBuffer []byte) error {
+	return this.AppendByReaderContext(ctx, appenderFileId, bytes.NewReader(fileBuffer), int64(len(fileBuffer)))
+}
+
+func (this *FdfsClient) AppendByReader(appenderFileId string, reader io.Reader, size int64) error {
+	return this.AppendByReaderContext(context.Background(), appenderFileId, reader, size)
+}
+
+func (this *FdfsClient) AppendByReaderContext(ctx context.Context, appenderFileId string, reader io.Reader, size int64) error {
+	fid, store, err := this.queryUpdateStorage(ctx, appenderFileId)
 	if err != nil {
-		return "", err
+		return err
 	}
+	return store.AppendByReaderContext(ctx, fid.FileName, reader, size)
+}
+
+func (this *FdfsClient) ModifyByBuffer(appenderFileId string, offset int64, fileBuffer []byte) error {
+	return this.ModifyByBufferContext(context.Background(), appenderFileId, offset, fileBuffer)
+}
+
+func (this *FdfsClient) ModifyByBufferContext(ctx context.Context, appenderFileId string, offset int64, fileBuffer []byte) error {
+	return this.ModifyByReaderContext(ctx, appenderFileId, offset, bytes.NewReader(fileBuffer), int64(len(fileBuffer)))
+}
+
+func (this *FdfsClient) ModifyByReader(appenderFileId string, offset int64, reader io.Reader, size int64) error {
+	return this.ModifyByReaderContext(context.Background(), appenderFileId, offset, reader, size)
+}
 
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageStoreWithGroup(masterFid.GroupName)
+func (this *FdfsClient) ModifyByReaderContext(ctx context.Context, appenderFileId string, offset int64, reader io.Reader, size int64) error {
+	fid, store, err := this.queryUpdateStorage(ctx, appenderFileId)
 	if err != nil {
-		return "", err
+		return err
 	}
-	fid, e := store.UploadSlaveByFilename(filename, prefixName, masterFid.FileName)
-	if e != nil {
-		return "", e
+	return store.ModifyByReaderContext(ctx, fid.FileName, offset, reader, size)
+}
+
+func (this *FdfsClient) TruncateFile(appenderFileId string, truncatedFileSize int64) error {
+	return this.TruncateFileContext(context.Background(), appenderFileId, truncatedFileSize)
+}
+
+func (this *FdfsClient) TruncateFileContext(ctx context.Context, appenderFileId string, truncatedFileSize int64) error {
+	fid, store, err := this.queryUpdateStorage(ctx, appenderFileId)
+	if err != nil {
+		return err
 	}
-	return fid.GetFileIdStr(), nil
+	return store.TruncateFileContext(ctx, fid.FileName, truncatedFileSize)
+}
+
+func (this *FdfsClient) RegenerateAppenderFilename(appenderFileId string) (remoteFileId string, e error) {
+	return this.RegenerateAppenderFilenameContext(context.Background(), appenderFileId)
 }
 
-func (this *FdfsClient) UploadSlaveByBuffer(fileBuffer []byte, masterFileId, fileExtName string) (remoteFileId string, e error) {
-	masterFid, err := NewFileIdFromStr(masterFileId)
+// RegenerateAppenderFilenameContext turns an appender file into a normal file,
+// the file gets a new id and can't be appended any more
+func (this *FdfsClient) RegenerateAppenderFilenameContext(ctx context.Context, appenderFileId string) (remoteFileId string, e error) {
+	fid, store, err := this.queryUpdateStorage(ctx, appenderFileId)
 	if err != nil {
 		return "", err
 	}
-
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageStoreWithGroup(masterFid.GroupName)
+	newFid, err := store.RegenerateAppenderFilenameContext(ctx, fid.FileName)
 	if err != nil {
 		return "", err
 	}
+	return newFid.GetFileIdStr(), nil
+}
+
+// queryUpdateStorage returns the source storage of remoteFileId, the one that
+// accepts changes to the file
+func (this *FdfsClient) queryUpdateStorage(ctx context.Context, remoteFileId string) (*FileId, *StorageClient, error) {
+	fid, err := NewFileIdFromStr(remoteFileId)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	fid, e := store.UploadSlaveByBuffer(fileBuffer, masterFid.FileName, fileExtName)
-	if e != nil {
-		return "", e
+	tc := this.trackerClient()
+	store, err := tc.QueryStorageUpdateContext(ctx, fid)
+	if err != nil {
+		return nil, nil, err
 	}
-	return fid.GetFileIdStr(), nil
+	return fid, store, nil
 }
 
-//func (this *FdfsClient) UploadAppenderByFilename(filename string) (string, error) {
-//	if _, err := os.Stat(filename); err != nil {
-//		return nil, errors.New(err.Error() + "(uploading)")
-//	}
-//
-//	tc := TrackerClient{this.ConnPool}
-//	store, err := tc.QueryStorageStoreWithoutGroup()
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return store.UploadAppenderByFilename(filename)
-//}
-
-//func (this *FdfsClient) UploadAppenderByBuffer(fileBuffer []byte, fileExtName string) (*FileId, error) {
-//	tc := TrackerClient{this.ConnPool}
-//	store, err := tc.QueryStorageStoreWithoutGroup()
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return store.UploadAppenderByBuffer(fileBuffer, fileExtName)
-//}
-
 func (this *FdfsClient) DeleteFile(remoteFileId string) error {
+	return this.DeleteFileContext(context.Background(), remoteFileId)
+}
+
+func (this *FdfsClient) DeleteFileContext(ctx context.Context, remoteFileId string) error {
+	fid, err := NewFileIdFromStr(remoteFileId)
+	if err != nil {
+		return err
+	}
+
+	tc := this.trackerClient()
+	store, err := tc.QueryStorageUpdateContext(ctx, fid)
+	if err != nil {
+		return err
+	}
+
+	return store.DeleteFileContext(ctx, fid.FileName)
+}
+
+// flag is STORAGE_SET_METADATA_FLAG_OVERWRITE or STORAGE_SET_METADATA_FLAG_MERGE
+func (this *FdfsClient) SetMetadata(remoteFileId string, metadata map[string]string, flag byte) error {
+	return this.SetMetadataContext(context.Background(), remoteFileId, metadata, flag)
+}
+
+func (this *FdfsClient) SetMetadataContext(ctx context.Context, remoteFileId string, metadata map[string]string, flag byte) error {
 	fid, err := NewFileIdFromStr(remoteFileId)
 	if err != nil {
 		return err
 	}
 
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageUpdate(fid)
+	tc := this.trackerClient()
+	store, err := tc.QueryStorageUpdateContext(ctx, fid)
 	if err != nil {
 		return err
 	}
 
-	return store.DeleteFile(fid.FileName)
+	return store.SetMetadataContext(ctx, fid.FileName, metadata, flag)
+}
+
+func (this *FdfsClient) GetMetadata(remoteFileId string) (map[string]string, error) {
+	return this.GetMetadataContext(context.Background(), remoteFileId)
+}
+
+func (this *FdfsClient) GetMetadataContext(ctx context.Context, remoteFileId string) (map[string]string, error) {
+	fid, err := NewFileIdFromStr(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := this.trackerClient()
+	store, err := tc.QueryStorageFetchContext(ctx, fid)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetMetadataContext(ctx, fid.FileName)
+}
+
+func (this *FdfsClient) QueryFileInfo(remoteFileId string) (*FileInfo, error) {
+	return this.QueryFileInfoContext(context.Background(), remoteFileId)
+}
+
+func (this *FdfsClient) QueryFileInfoContext(ctx context.Context, remoteFileId string) (*FileInfo, error) {
+	fid, err := NewFileIdFromStr(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := this.trackerClient()
+	store, err := tc.QueryStorageFetchContext(ctx, fid)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.QueryFileInfoContext(ctx, fid.FileName)
 }
 
 func (this *FdfsClient) DownloadToFile(remoteFileId string, localFilename string) (size int64, e error) {
+	return this.DownloadToFileContext(context.Background(), remoteFileId, localFilename)
+}
+
+func (this *FdfsClient) DownloadToFileContext(ctx context.Context, remoteFileId string, localFilename string) (size int64, e error) {
 	file, err := os.Create(localFilename)
 	if err != nil {
 		return 0, err
 	}
 	defer file.Close()
-	return this.DownloadEx(remoteFileId, file, 0, 0)
+	return this.DownloadExContext(ctx, remoteFileId, file, 0, 0)
 }
 
 func (this *FdfsClient) DownloadEx(remoteFileId string, output io.Writer, offset int64, downloadSize int64) (size int64, e error) {
+	return this.DownloadExContext(context.Background(), remoteFileId, output, offset, downloadSize)
+}
+
+func (this *FdfsClient) DownloadExContext(ctx context.Context, remoteFileId string, output io.Writer, offset int64, downloadSize int64) (size int64, e error) {
 	fid, err := NewFileIdFromStr(remoteFileId)
 	if err != nil {
 		return 0, err
 	}
-	tc := TrackerClient{this.ConnPool}
-	store, err := tc.QueryStorageFetch(fid)
-	if err != nil {
-		return 0, err
-	}
+	return this.download(ctx, fid, output, offset, downloadSize)
+}
+
+func (this *FdfsClient) ListGroups() ([]*GroupStat, error) {
+	return this.ListGroupsContext(context.Background())
+}
+
+func (this *FdfsClient) ListGroupsContext(ctx context.Context) ([]*GroupStat, error) {
+	tc := this.trackerClient()
+	return tc.ListGroupsContext(ctx)
+}
+
+func (this *FdfsClient) ListOneGroup(groupName string) (*GroupStat, error) {
+	return this.ListOneGroupContext(context.Background(), groupName)
+}
+
+func (this *FdfsClient) ListOneGroupContext(ctx context.Context, groupName string) (*GroupStat, error) {
+	tc := this.trackerClient()
+	return tc.ListOneGroupContext(ctx, groupName)
+}
+
+func (this *FdfsClient) ListStorages(groupName string, storageId string) ([]*StorageStat, error) {
+	return this.ListStoragesContext(context.Background(), groupName, storageId)
+}
+
+func (this *FdfsClient) ListStoragesContext(ctx context.Context, groupName string, storageId string) ([]*StorageStat, error) {
+	tc := this.trackerClient()
+	return tc.ListStoragesContext(ctx, groupName, storageId)
+}
+
+func (this *FdfsClient) DeleteStorage(groupName string, storageId string) error {
+	return this.DeleteStorageContext(context.Background(), groupName, storageId)
+}
 
-	return store.DownloadEx(fid.FileName, output, offset, downloadSize)
+func (this *FdfsClient) DeleteStorageContext(ctx context.Context, groupName string, storageId string) error {
+	tc := this.trackerClient()
+	return tc.DeleteStorageContext(ctx, groupName, storageId)
 }
@@ -3,32 +3,47 @@ package fdfs_client
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
 )
 
 var (
-	trackers    = []string{"192.168.199.2"}
-	trackerPort = 22122
-	connPool    *ConnectionPool
+	// every test runs against an in-memory cluster with two replicas
+	cluster  *fdfstest.Cluster
+	connPool *ConnectionPool
 )
 
-func init() {
+func TestMain(m *testing.M) {
 	var e error
+	cluster, e = fdfstest.NewCluster("group1", 2)
+	if e != nil {
+		fmt.Println("NewCluster error:", e)
+		os.Exit(1)
+	}
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
 	connPool, e = NewConnectionPool(
-		trackers,
-		trackerPort,
+		[]string{host},
+		port,
 		10,
 		150,
 	)
 	if e != nil {
 		fmt.Println("NewConnectionPool error:", e)
-		return
+		os.Exit(1)
 	}
+	code := m.Run()
+	connPool.Close()
+	cluster.Close()
+	os.Exit(code)
 }
 
 type MemData struct {
@@ -222,6 +237,30 @@ func TestUploadSlaveByFilename(t *testing.T) {
 	}
 }
 
+func TestUploadSlaveByBuffer(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	masterFileId, err := fdfsClient.UploadByBuffer([]byte("master"), "txt")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(masterFileId)
+
+	slaveFileId, err := fdfsClient.UploadSlaveByBuffer([]byte("slave"), masterFileId, "_small", "txt")
+	if err != nil {
+		t.Fatal("UploadSlaveByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(slaveFileId)
+	buf := &bytes.Buffer{}
+	if _, err = fdfsClient.DownloadEx(slaveFileId, buf, 0, 0); err != nil || buf.String() != "slave" {
+		t.Fatalf("slave file %s has %q, %v", slaveFileId, buf.String(), err)
+	}
+
+	if _, err = fdfsClient.UploadSlaveByBuffer([]byte("slave"), masterFileId, "", "txt"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("UploadSlaveByBuffer without prefix returns %v, expect ErrInvalidArgument", err)
+	}
+}
+
 func TestDownloadToFile(t *testing.T) {
 	fdfsClient := FdfsClient{ConnPool: connPool}
 
@@ -248,6 +287,317 @@ func TestDownloadToFile(t *testing.T) {
 	os.Remove(localFilename)
 }
 
+func TestAppenderFile(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	remoteFileId, err := fdfsClient.UploadAppenderByBuffer([]byte("12345"), "txt")
+	if err != nil {
+		t.Fatal("UploadAppenderByBuffer error:", err.Error())
+	}
+	t.Log("appender file:", remoteFileId)
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	if err = fdfsClient.AppendByBuffer(remoteFileId, []byte("67890")); err != nil {
+		t.Fatal("AppendByBuffer error:", err.Error())
+	}
+	if err = fdfsClient.ModifyByBuffer(remoteFileId, 2, []byte("ab")); err != nil {
+		t.Fatal("ModifyByBuffer error:", err.Error())
+	}
+	if err = fdfsClient.TruncateFile(remoteFileId, 8); err != nil {
+		t.Fatal("TruncateFile error:", err.Error())
+	}
+
+	var buf bytes.Buffer
+	if _, err = fdfsClient.DownloadEx(remoteFileId, &buf, 0, 0); err != nil {
+		t.Fatal("DownloadEx error:", err.Error())
+	}
+	if buf.String() != "12ab5678" {
+		t.Fatalf("appender content error: %q", buf.String())
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	remoteFileId, err := fdfsClient.UploadByFilename("README.md")
+	if err != nil {
+		t.Fatal("UploadByfilename error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	meta := map[string]string{"filename": "README.md", "content-type": "text/markdown"}
+	err = fdfsClient.SetMetadata(remoteFileId, meta, STORAGE_SET_METADATA_FLAG_OVERWRITE)
+	if err != nil {
+		t.Fatal("SetMetadata error:", err.Error())
+	}
+	err = fdfsClient.SetMetadata(remoteFileId, map[string]string{"width": "100"}, STORAGE_SET_METADATA_FLAG_MERGE)
+	if err != nil {
+		t.Fatal("SetMetadata merge error:", err.Error())
+	}
+
+	got, err := fdfsClient.GetMetadata(remoteFileId)
+	if err != nil {
+		t.Fatal("GetMetadata error:", err.Error())
+	}
+	if len(got) != 3 || got["filename"] != "README.md" || got["width"] != "100" {
+		t.Fatalf("GetMetadata result error: %v", got)
+	}
+
+	longName := string(bytes.Repeat([]byte("n"), FDFS_MAX_META_NAME_LEN+1))
+	err = fdfsClient.SetMetadata(remoteFileId, map[string]string{longName: "v"}, STORAGE_SET_METADATA_FLAG_MERGE)
+	if err == nil {
+		t.Fatal("SetMetadata should reject a too long name")
+	}
+}
+
+func TestQueryFileInfo(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	fileBuffer := []byte("1234567890")
+	remoteFileId, err := fdfsClient.UploadByBuffer(fileBuffer, "txt")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	info, err := fdfsClient.QueryFileInfo(remoteFileId)
+	if err != nil {
+		t.Fatal("QueryFileInfo error:", err.Error())
+	}
+	t.Logf("file info: %+v", info)
+	if info.FileSize != int64(len(fileBuffer)) {
+		t.Fatalf("file size error: %d", info.FileSize)
+	}
+	if info.Crc32 != crc32.ChecksumIEEE(fileBuffer) {
+		t.Fatalf("crc32 error: %x", info.Crc32)
+	}
+}
+
+func TestListGroupsAndStorages(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	groups, err := fdfsClient.ListGroups()
+	if err != nil {
+		t.Fatal("ListGroups error:", err.Error())
+	}
+	if len(groups) == 0 {
+		t.Fatal("ListGroups returns no group")
+	}
+	for _, group := range groups {
+		t.Logf("group: %+v", group)
+		one, err := fdfsClient.ListOneGroup(group.GroupName)
+		if err != nil {
+			t.Fatal("ListOneGroup error:", err.Error())
+		}
+		if one.GroupName != group.GroupName {
+			t.Fatalf("ListOneGroup name error: %s", one.GroupName)
+		}
+		storages, err := fdfsClient.ListStorages(group.GroupName, "")
+		if err != nil {
+			t.Fatal("ListStorages error:", err.Error())
+		}
+		if int64(len(storages)) != group.StorageCount {
+			t.Fatalf("ListStorages count error: %d != %d", len(storages), group.StorageCount)
+		}
+		for _, storage := range storages {
+			t.Logf("storage %s: %s", storage.IpAddr, storage.Status)
+		}
+	}
+
+	// a storage id is shorter than FDFS_STORAGE_ID_MAX_SIZE
+	longId := strings.Repeat("1", FDFS_STORAGE_ID_MAX_SIZE)
+	if _, err = fdfsClient.ListStorages("group1", longId); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("ListStorages of a long storage id returns %v, expect ErrInvalidArgument", err)
+	}
+	if err = fdfsClient.DeleteStorage("group1", longId); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("DeleteStorage of a long storage id returns %v, expect ErrInvalidArgument", err)
+	}
+}
+
+func TestUploadFailover(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool, UploadFailover: true}
+
+	// the tracker lists the full storage first for one of the two uploads
+	full := cluster.Storages[0]
+	full.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_FILE, Status: fdfstest.ENOSPC})
+	defer full.ClearFaults()
+
+	// io.MultiReader is not seekable, so it is buffered for retries
+	fdfsClient.FailoverBufferSize = 1024
+	for i := 0; i < 2; i++ {
+		remoteFileId, err := fdfsClient.UploadByReader(io.MultiReader(bytes.NewReader([]byte("12345"))), 5, "txt")
+		if err != nil {
+			t.Fatal("UploadByReader error:", err.Error())
+		}
+		t.Log(remoteFileId)
+		fdfsClient.DeleteFile(remoteFileId)
+	}
+	if full.Requests(STORAGE_PROTO_CMD_UPLOAD_FILE) == 0 {
+		t.Fatal("the full storage is never tried")
+	}
+
+	// a request refused as invalid is not sent to the other storages
+	full.ClearFaults()
+	uploads := 0
+	for _, s := range cluster.Storages {
+		s.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_FILE, Status: fdfstest.EINVAL, Times: 1})
+		uploads += s.Requests(STORAGE_PROTO_CMD_UPLOAD_FILE)
+	}
+	if _, err := fdfsClient.UploadByBuffer([]byte("12345"), "txt"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("UploadByBuffer returns %v, expect ErrInvalidArgument", err)
+	}
+	for _, s := range cluster.Storages {
+		uploads -= s.Requests(STORAGE_PROTO_CMD_UPLOAD_FILE)
+		s.ClearFaults()
+	}
+	if uploads != -1 {
+		t.Fatalf("an invalid upload is sent to %d storages, expect 1", -uploads)
+	}
+	full.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_FILE, Status: fdfstest.ENOSPC})
+
+	fdfsClient.UploadFailover = false
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if _, err := fdfsClient.UploadByBuffer([]byte("12345"), "txt"); err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d uploads failed without failover, expect 1", failed)
+	}
+
+	// a slave file goes to the source storage of its master, with no failover
+	fdfsClient.UploadFailover = true
+	masterFileId, err := fdfsClient.UploadByBuffer([]byte("master"), "txt")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(masterFileId)
+	full.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, Status: fdfstest.ENOSPC})
+	other := cluster.Storages[1]
+	slaves := other.Requests(STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE)
+	if _, err = fdfsClient.UploadSlaveByBuffer([]byte("slave"), masterFileId, "_slave", "txt"); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("UploadSlaveByBuffer returns %v, expect ErrNoSpace", err)
+	}
+	if n := other.Requests(STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE); n != slaves {
+		t.Fatalf("slave upload fails over to %d other storages", n-slaves)
+	}
+}
+
+func TestDownloadReplicas(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool, DownloadFailover: true}
+
+	remoteFileId, err := fdfsClient.UploadByBuffer([]byte("1234567890"), "txt")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	fid, _ := NewFileIdFromStr(remoteFileId)
+	tc := TrackerClient{Pool: connPool}
+	stores, err := tc.QueryStorageFetchAll(fid)
+	if err != nil {
+		t.Fatal("QueryStorageFetchAll error:", err.Error())
+	}
+	if len(stores) < 2 {
+		t.Skip("replicas need the 127.0.0.0/8 loopback addresses")
+	}
+
+	// every replica drops its first download
+	for _, storage := range cluster.Storages {
+		storage.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_DOWNLOAD_FILE, Drop: true, Times: 1})
+	}
+	defer func() {
+		for _, storage := range cluster.Storages {
+			storage.ClearFaults()
+		}
+	}()
+
+	var buf bytes.Buffer
+	if _, err = fdfsClient.DownloadEx(remoteFileId, &buf, 2, 5); err == nil {
+		t.Fatal("DownloadEx should fail when every replica fails")
+	}
+	buf.Reset()
+	if _, err = fdfsClient.DownloadEx(remoteFileId, &buf, 2, 5); err != nil {
+		t.Fatal("DownloadEx error:", err.Error())
+	}
+	if buf.String() != "34567" {
+		t.Fatalf("download content error: %q", buf.String())
+	}
+
+	// a range beyond the end of the file is cut at the end, an offset beyond
+	// it is invalid
+	buf.Reset()
+	if n, err := fdfsClient.DownloadEx(remoteFileId, &buf, 8, 5); err != nil || n != 2 || buf.String() != "90" {
+		t.Fatalf("download beyond the end returns %d bytes %q, %v", n, buf.String(), err)
+	}
+	// an invalid download is not sent to the other replicas
+	downloads := 0
+	for _, storage := range cluster.Storages {
+		downloads += storage.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE)
+	}
+	if _, err = fdfsClient.DownloadEx(remoteFileId, &buf, 11, 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("download at an offset beyond the end returns %v, expect ErrInvalidArgument", err)
+	}
+	for _, storage := range cluster.Storages {
+		downloads -= storage.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE)
+	}
+	if downloads != -1 {
+		t.Fatalf("an invalid download is sent to %d replicas, expect 1", -downloads)
+	}
+
+	// one replica is slow, the tracker lists it first for one of the two
+	// downloads and the hedged request wins
+	cluster.Storages[0].Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_DOWNLOAD_FILE, Delay: 5 * time.Second})
+	fdfsClient.HedgeDelay = 10 * time.Millisecond
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if _, err = fdfsClient.DownloadEx(remoteFileId, &buf, 0, 0); err != nil {
+			t.Fatal("hedged DownloadEx error:", err.Error())
+		}
+		if buf.String() != "1234567890" {
+			t.Fatalf("hedged download content error: %q", buf.String())
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("hedged DownloadEx waits for the slow replica")
+	}
+}
+
+func TestReplayReader(t *testing.T) {
+	data := []byte("1234567890")
+
+	// seekable input rewinds to where it started
+	br := bytes.NewReader(data)
+	br.Seek(2, io.SeekStart)
+	replay, _ := newReplayReader(br, 8, 0)
+	io.CopyN(io.Discard, replay.reader(), 4)
+	if !replay.rewind() {
+		t.Fatal("seekable input should rewind")
+	}
+	if b, _ := io.ReadAll(replay.reader()); string(b) != "34567890" {
+		t.Fatalf("rewind to wrong offset: %s", b)
+	}
+
+	// small non seekable input is buffered
+	replay, _ = newReplayReader(io.MultiReader(bytes.NewReader(data)), 10, 10)
+	io.CopyN(io.Discard, replay.reader(), 4)
+	if !replay.rewind() {
+		t.Fatal("buffered input should rewind")
+	}
+
+	// large non seekable input can only be retried before it is read
+	replay, _ = newReplayReader(io.MultiReader(bytes.NewReader(data)), 10, 5)
+	if !replay.rewind() {
+		t.Fatal("unread input should rewind")
+	}
+	io.CopyN(io.Discard, replay.reader(), 4)
+	if replay.rewind() {
+		t.Fatal("consumed non seekable input should not rewind")
+	}
+}
+
 func formatSize(sz int64) string {
 	if sz < 1024*1024 {
 		return fmt.Sprintf("%.2f Kb", float64(sz)/1024.0)
@@ -295,11 +645,11 @@ func BenchmarkUpload(b *testing.B) {
 		mtd.ResetRead()
 		remoteFileId, err := fdfsClient.UploadByReader(&mtd, mtd.Size, "png")
 		if err != nil {
-			fmt.Errorf("UploadByfilename error %s", err.Error())
+			b.Fatalf("UploadByfilename error %s", err.Error())
 		}
 		err = fdfsClient.DeleteFile(remoteFileId)
 		if err != nil {
-			fmt.Errorf("DeleteFile error %s", err.Error())
+			b.Fatalf("DeleteFile error %s", err.Error())
 		}
 	}
 }
@@ -309,7 +659,7 @@ func BenchmarkDownload(b *testing.B) {
 	mtd := MemData{FillBytes: []byte("1234567890abcdef"), Size: 1024 * 1024}
 	remoteFileId, err := fdfsClient.UploadByReader(&mtd, mtd.Size, "png")
 	if err != nil {
-		fmt.Errorf("UploadByReader error %s", err.Error())
+		b.Fatalf("UploadByReader error %s", err.Error())
 	}
 	defer fdfsClient.DeleteFile(remoteFileId)
 	b.ResetTimer()
@@ -318,7 +668,7 @@ func BenchmarkDownload(b *testing.B) {
 		mtd.ResetWrite()
 		_, err = fdfsClient.DownloadEx(remoteFileId, &mtd, 0, 0)
 		if err != nil {
-			fmt.Errorf("DownloadToFile error %s", err.Error())
+			b.Fatalf("DownloadToFile error %s", err.Error())
 		}
 	}
 }
@@ -330,12 +680,12 @@ func BenchmarkQueryStorageFetch(b *testing.B) {
 	mtd := MemData{FillBytes: []byte("1234567890abcdef"), Size: 1024 * 1024}
 	remoteFileId, err := fdfsClient.UploadByReader(&mtd, mtd.Size, "png")
 	if err != nil {
-		fmt.Errorf("UploadByReader error %s", err.Error())
+		b.Fatalf("UploadByReader error %s", err.Error())
 	}
 	defer fdfsClient.DeleteFile(remoteFileId)
 	fid, _ := NewFileIdFromStr(remoteFileId)
 	b.ResetTimer()
-	tc := TrackerClient{connPool}
+	tc := TrackerClient{Pool: connPool}
 	for i := 0; i < b.N; i++ {
 		store, e := tc.QueryStorageFetch(fid)
 		if e != nil || store.IpAddr == "" {
@@ -0,0 +1,438 @@
+// Command fdfs runs the operations of the FastDFS client from the shell.
+//
+//	fdfs [-conf client.conf] [-tracker host:port]... [-json] <command> [args]
+//
+// The trackers are read from client.conf unless -tracker is given.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	fdfs "github.com/tnextday/fdfs_client"
+)
+
+const usage = `usage: fdfs [flags] <command> [args]
+
+commands:
+  upload [-ext ext] <local_file|->...
+  upload-slave [-ext ext] <local_file|-> <master_file_id> <prefix_name>
+  download [-offset n] [-length n] <file_id> [local_file|-]
+  delete <file_id>...
+  info <file_id>...
+  meta get <file_id>
+  meta set [-merge] <file_id> <key=value>...
+  cluster groups [group_name]
+  cluster storages <group_name> [storage_id]
+
+flags:
+`
+
+// exit status of usage errors, other errors exit with 1
+const exitUsage = 2
+
+var errUsage = errors.New("invalid arguments")
+
+type trackerList []string
+
+func (l *trackerList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *trackerList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// cli is a command run, its output goes to stdout and stderr
+type cli struct {
+	client  *fdfs.FdfsClient
+	out     *output
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	timeout time.Duration
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line args and returns the exit status
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var (
+		confFile string
+		trackers trackerList
+		jsonOut  bool
+	)
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("fdfs", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&confFile, "conf", "/etc/fdfs/client.conf", "the client.conf to read the trackers from")
+	fs.Var(&trackers, "tracker", "a tracker `host:port`, can be repeated, overrides -conf")
+	fs.BoolVar(&jsonOut, "json", false, "print JSON instead of tables")
+	fs.DurationVar(&c.timeout, "timeout", 0, "the time limit of the command, 0 means no limit")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	c.out = &output{w: stdout, json: jsonOut}
+
+	var (
+		conf *fdfs.Config
+		err  error
+	)
+	if len(trackers) > 0 {
+		conf = fdfs.NewConfig()
+		conf.TrackerServers = trackers
+	} else if conf, err = fdfs.LoadConfig(confFile); err != nil {
+		fmt.Fprintln(stderr, "fdfs:", err)
+		return 1
+	}
+	if c.client, err = fdfs.NewFdfsClientFromConfig(conf); err != nil {
+		fmt.Fprintln(stderr, "fdfs:", err)
+		return 1
+	}
+	defer c.client.Close()
+
+	err = c.run(fs.Arg(0), fs.Args()[1:])
+	if err == errUsage {
+		fs.Usage()
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "fdfs:", err)
+		return 1
+	}
+	return 0
+}
+
+func (c *cli) run(cmd string, args []string) error {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	switch cmd {
+	case "upload":
+		return c.upload(ctx, args)
+	case "upload-slave":
+		return c.uploadSlave(ctx, args)
+	case "download":
+		return c.download(ctx, args)
+	case "delete":
+		return c.delete(ctx, args)
+	case "info":
+		return c.info(ctx, args)
+	case "meta":
+		if len(args) > 0 && args[0] == "get" {
+			return c.getMeta(ctx, args[1:])
+		}
+		if len(args) > 0 && args[0] == "set" {
+			return c.setMeta(ctx, args[1:])
+		}
+	case "cluster":
+		if len(args) > 0 && args[0] == "groups" {
+			return c.groups(ctx, args[1:])
+		}
+		if len(args) > 0 && args[0] == "storages" {
+			return c.storages(ctx, args[1:])
+		}
+	}
+	return errUsage
+}
+
+// parseFlags parses the flags of a command, it returns errUsage if the number
+// of the remaining args is not in [min, max], max < 0 means no limit
+func (c *cli) parseFlags(fs *flag.FlagSet, args []string, min, max int) error {
+	fs.SetOutput(c.stderr)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		return errUsage
+	}
+	return nil
+}
+
+// openInput opens a local file, stdin is read in memory for "-" as its size
+// must be known before the upload
+func (c *cli) openInput(name string) (io.ReadCloser, int64, error) {
+	if name == "-" {
+		buf, err := io.ReadAll(c.stdin)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(buf)), int64(len(buf)), nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+// extName is the -ext flag, or the extension of the local file
+func extName(name, ext string) string {
+	if ext != "" || name == "-" {
+		return ext
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 && !strings.ContainsRune(name[i:], os.PathSeparator) {
+		return name[i+1:]
+	}
+	return ""
+}
+
+type uploadResult struct {
+	Local  string `json:"local"`
+	FileId string `json:"file_id"`
+}
+
+func (c *cli) upload(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	ext := fs.String("ext", "", "the extension of the remote file, default to the one of the local file")
+	if err := c.parseFlags(fs, args, 1, -1); err != nil {
+		return err
+	}
+	var results []uploadResult
+	for _, name := range fs.Args() {
+		input, size, err := c.openInput(name)
+		if err != nil {
+			return err
+		}
+		fileId, err := c.client.UploadByReaderContext(ctx, input, size, extName(name, *ext))
+		input.Close()
+		if err != nil {
+			return err
+		}
+		results = append(results, uploadResult{Local: name, FileId: fileId})
+	}
+	return c.printUploads(results)
+}
+
+func (c *cli) uploadSlave(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upload-slave", flag.ContinueOnError)
+	ext := fs.String("ext", "", "the extension of the remote file, default to the one of the local file")
+	if err := c.parseFlags(fs, args, 3, 3); err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	input, size, err := c.openInput(name)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	fileId, err := c.client.UploadSlaveByReaderContext(ctx, input, size, fs.Arg(1), fs.Arg(2), extName(name, *ext))
+	if err != nil {
+		return err
+	}
+	return c.printUploads([]uploadResult{{Local: name, FileId: fileId}})
+}
+
+func (c *cli) printUploads(results []uploadResult) error {
+	if c.out.json {
+		if len(results) == 1 {
+			return c.out.printJSON(results[0])
+		}
+		return c.out.printJSON(results)
+	}
+	// only the file ids, so that they can be used by scripts
+	for _, r := range results {
+		fmt.Fprintln(c.stdout, r.FileId)
+	}
+	return nil
+}
+
+func (c *cli) download(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	offset := fs.Int64("offset", 0, "the offset to download from")
+	length := fs.Int64("length", 0, "the number of bytes to download, 0 means to the end of file")
+	if err := c.parseFlags(fs, args, 1, 2); err != nil {
+		return err
+	}
+	if *offset < 0 || *length < 0 {
+		return errUsage
+	}
+	var output io.Writer = c.stdout
+	if name := fs.Arg(1); name != "" && name != "-" {
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	_, err := c.client.DownloadExContext(ctx, fs.Arg(0), output, *offset, *length)
+	return err
+}
+
+func (c *cli) delete(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, fileId := range args {
+		if err := c.client.DeleteFileContext(ctx, fileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileInfo struct {
+	FileId          string    `json:"file_id"`
+	FileType        string    `json:"file_type"`
+	FileSize        int64     `json:"file_size"`
+	CreateTimestamp time.Time `json:"create_timestamp"`
+	Crc32           uint32    `json:"crc32"`
+	SourceIpAddr    string    `json:"source_ip_addr"`
+	SourceId        string    `json:"source_id,omitempty"`
+}
+
+func (c *cli) info(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	var infos []fileInfo
+	for _, fileId := range args {
+		fid, err := fdfs.NewFileIdFromStr(fileId)
+		if err != nil {
+			return err
+		}
+		fi, err := c.client.QueryFileInfoContext(ctx, fileId)
+		if err != nil {
+			return err
+		}
+		info := fileInfo{
+			FileId:          fileId,
+			FileSize:        fi.FileSize,
+			CreateTimestamp: fi.CreateTimestamp,
+			Crc32:           fi.Crc32,
+			SourceIpAddr:    fi.SourceIpAddr,
+		}
+		if decoded, err := fid.Decode(); err == nil {
+			info.FileType = decoded.FileType.String()
+			info.SourceId = decoded.SourceId
+		}
+		infos = append(infos, info)
+	}
+	if c.out.json {
+		if len(infos) == 1 {
+			return c.out.printJSON(infos[0])
+		}
+		return c.out.printJSON(infos)
+	}
+	rows := make([][]string, 0, len(infos))
+	for _, info := range infos {
+		rows = append(rows, []string{info.FileId, info.FileType, fmt.Sprint(info.FileSize),
+			formatTime(info.CreateTimestamp), fmt.Sprintf("%08X", info.Crc32), info.SourceIpAddr})
+	}
+	return c.out.printTable([]string{"FILE_ID", "TYPE", "SIZE", "CREATED", "CRC32", "SOURCE"}, rows)
+}
+
+func (c *cli) getMeta(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	metadata, err := c.client.GetMetadataContext(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if c.out.json {
+		return c.out.printJSON(metadata)
+	}
+	return c.out.printTable([]string{"KEY", "VALUE"}, sortedPairs(metadata))
+}
+
+func (c *cli) setMeta(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("meta set", flag.ContinueOnError)
+	merge := fs.Bool("merge", false, "merge with the current metadata instead of replacing it")
+	if err := c.parseFlags(fs, args, 2, -1); err != nil {
+		return err
+	}
+	metadata := make(map[string]string)
+	for _, pair := range fs.Args()[1:] {
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return fmt.Errorf("invalid metadata %q, expect key=value", pair)
+		}
+		metadata[pair[:i]] = pair[i+1:]
+	}
+	flag := byte(fdfs.STORAGE_SET_METADATA_FLAG_OVERWRITE)
+	if *merge {
+		flag = fdfs.STORAGE_SET_METADATA_FLAG_MERGE
+	}
+	return c.client.SetMetadataContext(ctx, fs.Arg(0), metadata, flag)
+}
+
+func (c *cli) groups(ctx context.Context, args []string) error {
+	var (
+		groups []*fdfs.GroupStat
+		err    error
+	)
+	switch len(args) {
+	case 0:
+		groups, err = c.client.ListGroupsContext(ctx)
+	case 1:
+		var group *fdfs.GroupStat
+		if group, err = c.client.ListOneGroupContext(ctx, args[0]); err == nil {
+			groups = []*fdfs.GroupStat{group}
+		}
+	default:
+		return errUsage
+	}
+	if err != nil {
+		return err
+	}
+	if c.out.json {
+		return c.out.printJSON(groups)
+	}
+	rows := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, []string{g.GroupName, fmt.Sprint(g.StorageCount), fmt.Sprint(g.ActiveCount),
+			fmt.Sprint(g.StoragePort), fmt.Sprint(g.TotalMB), fmt.Sprint(g.FreeMB)})
+	}
+	return c.out.printTable([]string{"GROUP", "STORAGES", "ACTIVE", "PORT", "TOTAL_MB", "FREE_MB"}, rows)
+}
+
+func (c *cli) storages(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUsage
+	}
+	storageId := ""
+	if len(args) == 2 {
+		storageId = args[1]
+	}
+	storages, err := c.client.ListStoragesContext(ctx, args[0], storageId)
+	if err != nil {
+		return err
+	}
+	if c.out.json {
+		return c.out.printJSON(storages)
+	}
+	rows := make([][]string, 0, len(storages))
+	for _, s := range storages {
+		rows = append(rows, []string{s.Id, s.IpAddr, fmt.Sprint(s.StoragePort), s.Status.String(), s.Version,
+			fmt.Sprint(s.TotalMB), fmt.Sprint(s.FreeMB), formatTime(s.UpTime)})
+	}
+	return c.out.printTable([]string{"ID", "IP_ADDR", "PORT", "STATUS", "VERSION", "TOTAL_MB", "FREE_MB", "UP_TIME"}, rows)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+func runCmd(t *testing.T, stdin string, args ...string) (string, int) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	if code != 0 {
+		t.Logf("fdfs %s: %s", strings.Join(args, " "), stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestCommands(t *testing.T) {
+	cluster, err := fdfstest.NewCluster("group1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	tracker := "-tracker=" + cluster.TrackerAddr()
+
+	local := filepath.Join(t.TempDir(), "test.txt")
+	os.WriteFile(local, []byte("1234567890"), 0644)
+	out, code := runCmd(t, "", tracker, "upload", local)
+	if code != 0 {
+		t.Fatal("upload failed")
+	}
+	fileId := strings.TrimSpace(out)
+	if !strings.HasPrefix(fileId, "group1/") || !strings.HasSuffix(fileId, ".txt") {
+		t.Fatalf("upload prints %q", out)
+	}
+
+	out, code = runCmd(t, "abc", tracker, "-json", "upload-slave", "-ext", "dat", "-", fileId, "_small")
+	var slave uploadResult
+	if code != 0 || json.Unmarshal([]byte(out), &slave) != nil || !strings.HasSuffix(slave.FileId, "_small.dat") {
+		t.Fatalf("upload-slave prints %q", out)
+	}
+
+	if out, code = runCmd(t, "", tracker, "download", "--offset", "2", "--length", "3", fileId); code != 0 || out != "345" {
+		t.Fatalf("download prints %q, expect 345", out)
+	}
+
+	out, code = runCmd(t, "", tracker, "-json", "info", fileId)
+	var info fileInfo
+	if code != 0 || json.Unmarshal([]byte(out), &info) != nil || info.FileSize != 10 || info.FileType != "NORMAL" {
+		t.Fatalf("info prints %q", out)
+	}
+
+	if _, code = runCmd(t, "", tracker, "meta", "set", fileId, "width=100", "height=200"); code != 0 {
+		t.Fatal("meta set failed")
+	}
+	if _, code = runCmd(t, "", tracker, "meta", "set", "-merge", fileId, "width=120"); code != 0 {
+		t.Fatal("meta set -merge failed")
+	}
+	if out, _ = runCmd(t, "", tracker, "meta", "get", fileId); !strings.Contains(out, "height  200") ||
+		!strings.Contains(out, "width   120") {
+		t.Fatalf("meta get prints %q", out)
+	}
+
+	if out, _ = runCmd(t, "", tracker, "cluster", "groups"); !strings.Contains(out, "group1") {
+		t.Fatalf("cluster groups prints %q", out)
+	}
+	if out, _ = runCmd(t, "", tracker, "cluster", "storages", "group1"); !strings.Contains(out, "ACTIVE") {
+		t.Fatalf("cluster storages prints %q", out)
+	}
+
+	if _, code = runCmd(t, "", tracker, "delete", slave.FileId, fileId); code != 0 {
+		t.Fatal("delete failed")
+	}
+	if _, code = runCmd(t, "", tracker, "info", fileId); code != 1 {
+		t.Fatalf("info of a deleted file exits with %d, expect 1", code)
+	}
+	if _, code = runCmd(t, "", tracker, "meta", "list", fileId); code != exitUsage {
+		t.Fatalf("unknown command exits with %d, expect %d", code, exitUsage)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// output prints the results of a command as JSON or as a table
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+func (o *output) printJSON(v interface{}) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (o *output) printTable(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(o.w, 0, 8, 2, ' ', 0)
+	io.WriteString(tw, strings.Join(header, "\t")+"\n")
+	for _, row := range rows {
+		io.WriteString(tw, strings.Join(row, "\t")+"\n")
+	}
+	return tw.Flush()
+}
+
+// sortedPairs returns the key value rows of m, sorted by key
+func sortedPairs(m map[string]string) [][]string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, []string{k, m[k]})
+	}
+	return rows
+}
+
+// zero times are printed as "-"
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
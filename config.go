@@ -0,0 +1,226 @@
+package fdfs_client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT = 30 * time.Second
+	DEFAULT_NETWORK_TIMEOUT = 30 * time.Second
+	DEFAULT_MIN_CONNS       = 1
+	DEFAULT_MAX_CONNS       = 150
+	// FastDFS closes the pooled connections idle for an hour
+	DEFAULT_POOL_IDLE_TIMEOUT = time.Hour
+	// idle connections are pinged every minute, well before the firewalls
+	// forget about them
+	DEFAULT_POOL_HEALTH_CHECK_INTERVAL = time.Minute
+
+	// max depth of nested #include directives
+	maxConfigIncludeDepth = 8
+)
+
+// Config is the content of a FastDFS client.conf
+type Config struct {
+	ConnectTimeout        time.Duration
+	NetworkTimeout        time.Duration
+	BasePath              string
+	LogLevel              string
+	TrackerServers        []string // host:port
+	HttpTrackerServerPort int
+	// http.anti_steal.* settings, see AntiSteal
+	AntiStealCheckToken     bool
+	AntiStealTokenTTL       time.Duration
+	AntiStealSecretKey      string
+	AntiStealTokenCheckFail string
+
+	// size of the connection pools, not part of client.conf
+	MinConns        int
+	MaxConns        int
+	StorageMaxIdle  int
+	StorageMaxConns int
+
+	// connection_pool_max_idle_time
+	PoolIdleTimeout time.Duration
+	// health of the pooled connections, not part of client.conf, see
+	// ConnectionPool. Idle connections are always tested on Get if
+	// PoolHealthCheckInterval is 0.
+	PoolMaxLifetime         time.Duration
+	PoolHealthCheckInterval time.Duration
+	PoolTestOnGet           bool
+	// TrackerSelector picks the tracker of a new connection, not part of
+	// client.conf, nil is RandomSelector
+	TrackerSelector Selector
+
+	items map[string][]string
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ConnectTimeout:  DEFAULT_CONNECT_TIMEOUT,
+		NetworkTimeout:  DEFAULT_NETWORK_TIMEOUT,
+		MinConns:        DEFAULT_MIN_CONNS,
+		MaxConns:        DEFAULT_MAX_CONNS,
+		StorageMaxIdle:  DEFAULT_STORAGE_MAX_IDLE,
+		StorageMaxConns: DEFAULT_STORAGE_MAX_CONNS,
+		PoolIdleTimeout: DEFAULT_POOL_IDLE_TIMEOUT,
+		items:           make(map[string][]string),
+
+		PoolHealthCheckInterval: DEFAULT_POOL_HEALTH_CHECK_INTERVAL,
+	}
+}
+
+// LoadConfig reads a client.conf, #include directives are resolved relative to
+// the directory of the file containing them.
+func LoadConfig(filename string) (*Config, error) {
+	conf := NewConfig()
+	if err := conf.load(filename, 0); err != nil {
+		return nil, err
+	}
+	if err := conf.apply(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return conf, nil
+}
+
+// ParseConfig reads a client.conf from r, #include directives are resolved
+// relative to baseDir.
+func ParseConfig(r io.Reader, baseDir string) (*Config, error) {
+	conf := NewConfig()
+	if err := conf.parse(r, baseDir, 0); err != nil {
+		return nil, err
+	}
+	if err := conf.apply(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Get returns the last value of key, or "" if the key is not set
+func (this *Config) Get(key string) string {
+	values := this.items[key]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// GetAll returns every value of a key that can occur more than once
+func (this *Config) GetAll(key string) []string {
+	return this.items[key]
+}
+
+func (this *Config) load(filename string, depth int) error {
+	if depth > maxConfigIncludeDepth {
+		return fmt.Errorf("%s: too many nested #include", filename)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return this.parse(file, filepath.Dir(filename), depth)
+}
+
+func (this *Config) parse(r io.Reader, baseDir string, depth int) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#include ") || strings.HasPrefix(line, "#include\t") {
+			include := strings.TrimSpace(line[len("#include"):])
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(baseDir, include)
+			}
+			if err := this.load(include, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		this.items[key] = append(this.items[key], value)
+	}
+	return scanner.Err()
+}
+
+func (this *Config) apply() error {
+	var err error
+	if v := this.Get("connect_timeout"); v != "" {
+		if this.ConnectTimeout, err = parseSeconds(v); err != nil {
+			return fmt.Errorf("invalid connect_timeout %q", v)
+		}
+	}
+	if v := this.Get("network_timeout"); v != "" {
+		if this.NetworkTimeout, err = parseSeconds(v); err != nil {
+			return fmt.Errorf("invalid network_timeout %q", v)
+		}
+	}
+	if v := this.Get("connection_pool_max_idle_time"); v != "" {
+		if this.PoolIdleTimeout, err = parseSeconds(v); err != nil {
+			return fmt.Errorf("invalid connection_pool_max_idle_time %q", v)
+		}
+	}
+	if v := this.Get("http.tracker_server_port"); v != "" {
+		if this.HttpTrackerServerPort, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid http.tracker_server_port %q", v)
+		}
+	}
+	if v := this.Get("http.anti_steal.check_token"); v != "" {
+		if this.AntiStealCheckToken, err = parseBool(v); err != nil {
+			return fmt.Errorf("invalid http.anti_steal.check_token %q", v)
+		}
+	}
+	if v := this.Get("http.anti_steal.token_ttl"); v != "" {
+		if this.AntiStealTokenTTL, err = parseSeconds(v); err != nil {
+			return fmt.Errorf("invalid http.anti_steal.token_ttl %q", v)
+		}
+	}
+	this.AntiStealSecretKey = this.Get("http.anti_steal.secret_key")
+	this.AntiStealTokenCheckFail = this.Get("http.anti_steal.token_check_fail")
+	this.BasePath = this.Get("base_path")
+	this.LogLevel = this.Get("log_level")
+
+	this.TrackerServers = nil
+	for _, server := range this.GetAll("tracker_server") {
+		if _, _, err := splitHostPort(server); err != nil {
+			return fmt.Errorf("invalid tracker_server %q", server)
+		}
+		this.TrackerServers = append(this.TrackerServers, server)
+	}
+	if len(this.TrackerServers) == 0 {
+		return fmt.Errorf("no tracker_server found")
+	}
+	return nil
+}
+
+func parseSeconds(v string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid seconds %q", v)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// parseBool accepts the boolean values of the FastDFS config files
+func parseBool(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid bool %q", v)
+}
@@ -0,0 +1,59 @@
+package fdfs_client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := LoadConfig("client.conf")
+	if err != nil {
+		t.Fatal("LoadConfig error:", err)
+	}
+	if conf.ConnectTimeout != 30*time.Second || conf.NetworkTimeout != 60*time.Second {
+		t.Fatalf("timeout error: %s, %s", conf.ConnectTimeout, conf.NetworkTimeout)
+	}
+	if len(conf.TrackerServers) != 1 || conf.TrackerServers[0] != "10.0.1.32:22122" {
+		t.Fatalf("tracker servers error: %v", conf.TrackerServers)
+	}
+	if conf.HttpTrackerServerPort != 8080 || conf.LogLevel != "info" {
+		t.Fatalf("config error: %+v", conf)
+	}
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	main := "connect_timeout = 5\n" +
+		"connection_pool_max_idle_time = 300\n" +
+		"tracker_server = 127.0.0.1:22122\n" +
+		"tracker_server = 127.0.0.2:22122\n" +
+		"#include conf.d/http.conf\n"
+	http := "http.tracker_server_port=8888\n" +
+		"tracker_server=127.0.0.3:22123\n" +
+		"http.anti_steal.check_token=true\n" +
+		"http.anti_steal.token_ttl=900\n" +
+		"http.anti_steal.secret_key=FastDFS1234567890\n"
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.WriteFile(filepath.Join(dir, "client.conf"), []byte(main), 0644)
+	os.WriteFile(filepath.Join(dir, "conf.d", "http.conf"), []byte(http), 0644)
+
+	conf, err := LoadConfig(filepath.Join(dir, "client.conf"))
+	if err != nil {
+		t.Fatal("LoadConfig error:", err)
+	}
+	if conf.ConnectTimeout != 5*time.Second || conf.NetworkTimeout != DEFAULT_NETWORK_TIMEOUT {
+		t.Fatalf("timeout error: %s, %s", conf.ConnectTimeout, conf.NetworkTimeout)
+	}
+	if conf.PoolIdleTimeout != 5*time.Minute || conf.PoolHealthCheckInterval != DEFAULT_POOL_HEALTH_CHECK_INTERVAL {
+		t.Fatalf("pool config error: %s, %s", conf.PoolIdleTimeout, conf.PoolHealthCheckInterval)
+	}
+	if len(conf.TrackerServers) != 3 || conf.HttpTrackerServerPort != 8888 {
+		t.Fatalf("config error: %+v", conf)
+	}
+	as := NewAntiStealFromConfig(conf)
+	if as == nil || as.TokenTTL != 900*time.Second || as.SecretKey != "FastDFS1234567890" {
+		t.Fatalf("anti steal config error: %+v", as)
+	}
+}
@@ -2,33 +2,61 @@ package fdfs_client
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
 var ErrClosed = errors.New("pool is closed")
 
+// aLongTimeAgo is a non-zero time far in the past, used to interrupt blocked io
+var aLongTimeAgo = time.Unix(1, 0)
+
 type PoolConn struct {
 	net.Conn
 	lastErr error
 	pool    *ConnectionPool
+	ep      *endpoint
+	// timeout bounds every single read and write, 0 means no limit
+	timeout time.Duration
+	// bytes sent and received, for Instrumentation
+	sent int64
+	recv int64
+	// closed is set once the connection is returned to its pool
+	closed  bool
+	created time.Time
+
+	mu          sync.Mutex
+	deadline    time.Time // deadline of the current request
+	interrupted bool
 }
 
 func (c *PoolConn) Close() error {
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	if c.pool == nil {
+		return c.Conn.Close()
+	}
 	if c.lastErr != nil {
 //		fmt.Println("PoolConn close with error, ", c.lastErr)
-		return c.Conn.Close()
-	} else {
-		return c.pool.put(c.Conn)
+		poolEvent(c.pool.instrumentation(), POOL_EVENT_DISCARD, c.RemoteAddr().String(), 0, c.lastErr)
+		c.pool.count(&c.ep.errorCloses)
+		return c.pool.release(c.Conn, c.ep, true)
 	}
+	return c.pool.put(c.Conn, c.ep, c.created)
 }
 
 func (c *PoolConn) Read(b []byte) (n int, err error) {
+	c.armTimeout()
 	n, err = c.Conn.Read(b)
+	c.recv += int64(n)
 	if err != nil {
 		c.lastErr = err
 	}
@@ -36,135 +64,652 @@ func (c *PoolConn) Read(b []byte) (n int, err error) {
 }
 
 func (c *PoolConn) Write(b []byte) (n int, err error) {
+	c.armTimeout()
 	n, err = c.Conn.Write(b)
+	c.sent += int64(n)
 	if err != nil {
 		c.lastErr = err
 	}
 	return
 }
 
+// armTimeout moves the deadline of the socket to now + timeout before an io,
+// but never beyond the deadline of the current request.
+func (c *PoolConn) armTimeout() {
+	if c.timeout <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupted {
+		return
+	}
+	d := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(d) {
+		d = c.deadline
+	}
+	c.Conn.SetDeadline(d)
+}
+
+func (c *PoolConn) setRequestDeadline(d time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = d
+	c.Conn.SetDeadline(d)
+}
+
+func (c *PoolConn) interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interrupted = true
+	c.Conn.SetDeadline(aLongTimeAgo)
+}
+
 type ConnectionPool struct {
-	Hosts    []string
-	Port     int
+	// Addrs are the host:port of the servers
+	Addrs    []string
 	MinConns int
 	MaxConns int
-	conns    chan net.Conn
+	// ConnectTimeout bounds the dial of a connection
+	ConnectTimeout time.Duration
+	// NetworkTimeout bounds every read and write, 0 means no limit
+	NetworkTimeout time.Duration
+	// Instrumentation, if not nil, is told about the connections of the pool.
+	// Change it with SetInstrumentation once the pool is used.
+	Instrumentation Instrumentation
+	// IdleTimeout closes the connections idle for longer, 0 means never
+	IdleTimeout time.Duration
+	// MaxLifetime closes the connections older than it, 0 means never
+	MaxLifetime time.Duration
+	// HealthCheckInterval is the period of the background checks of the
+	// pool, 0 disables them. Every check pings the connections idle for an
+	// interval, closes the stale ones and dials connections up to MinConns.
+	// The checks start with the first Get and stop on Close.
+	HealthCheckInterval time.Duration
+	// TestOnGet sends FDFS_PROTO_CMD_ACTIVE_TEST on an idle connection before
+	// it is returned by Get
+	TestOnGet bool
+	// Selector picks the server of a new connection, nil is RandomSelector
+	Selector Selector
+	// QuarantineTime is how long a server is skipped after a failed dial,
+	// unless every server is in quarantine. 0 disables the quarantine.
+	QuarantineTime time.Duration
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	idle      []idleConn
+	maxIdle   int
+	// open counts the connections idle, in use and being dialed
+	open int
+	// waiters are the Gets waiting for a connection, first in first out
+	waiters []chan struct{}
+	closed  bool
+	// stopCheck stops the health checks, it is nil until they start
+	stopCheck chan struct{}
+	// the Gets that waited for a connection, and how long
+	waitCount    int64
+	waitDuration time.Duration
+}
+
+type idleConn struct {
+	conn    net.Conn
+	ep      *endpoint
+	created time.Time
+	idleAt  time.Time
+	// checked is the last time the connection was known to be alive
+	checked time.Time
 }
 
 func NewConnectionPool(hosts []string, port int, minConns int, maxConns int) (*ConnectionPool, error) {
-	if minConns < 0 || maxConns <= 0 || minConns > maxConns {
-		return nil, errors.New("invalid conns settings")
+	if port == 0 {
+		return nil, fmt.Errorf("%w: port must not be zero", ErrInvalidArgument)
 	}
-	if len(hosts) == 0 {
-		return nil, errors.New("no hosts found")
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(port))
 	}
-	if port == 0 {
-		return nil, errors.New("port must not be zero.")
+	return NewConnectionPoolWithAddrs(addrs, minConns, maxConns)
+}
+
+// NewConnectionPoolWithAddrs returns a pool of connections to the servers at
+// addrs, host:port, that may listen on different ports
+func NewConnectionPoolWithAddrs(addrs []string, minConns int, maxConns int) (*ConnectionPool, error) {
+	cp, err := newConnectionPool(addrs, minConns, maxConns, time.Minute, 0)
+	if err != nil {
+		return nil, err
 	}
-	cp := &ConnectionPool{
-		Hosts:    hosts,
-		Port:     port,
-		MinConns: minConns,
-		MaxConns: maxConns,
-		conns:    make(chan net.Conn, maxConns),
+	if err = cp.fill(); err != nil {
+		cp.Close()
+		return nil, err
 	}
-	for i := 0; i < minConns; i++ {
-		conn, err := cp.makeConn()
-		if err != nil {
-			cp.Close()
+	return cp, nil
+}
+
+// newConnectionPool returns a pool without connections, fill dials MinConns
+// connections once the pool is set up
+func newConnectionPool(addrs []string, minConns int, maxConns int,
+	connectTimeout time.Duration, networkTimeout time.Duration) (*ConnectionPool, error) {
+	if minConns < 0 || maxConns <= 0 || minConns > maxConns {
+		return nil, fmt.Errorf("%w: invalid conns settings", ErrInvalidArgument)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: no hosts found", ErrInvalidArgument)
+	}
+	for _, addr := range addrs {
+		if _, _, err := splitHostPort(addr); err != nil {
 			return nil, err
 		}
-		cp.conns <- conn
 	}
-	return cp, nil
+	return &ConnectionPool{
+		Addrs:    addrs,
+		MinConns: minConns,
+		MaxConns: maxConns,
+
+		ConnectTimeout: connectTimeout,
+		NetworkTimeout: networkTimeout,
+		TestOnGet:      true,
+		QuarantineTime: DEFAULT_QUARANTINE_TIME,
+		endpoints:      newEndpoints(addrs),
+		maxIdle:        maxConns,
+	}, nil
 }
 
 func (this *ConnectionPool) Get() (net.Conn, error) {
-	if this.conns == nil {
-		return nil, ErrClosed
-	}
+	return this.GetContext(context.Background())
+}
+
+// GetContext returns a pooled connection. When the pool has MaxConns
+// connections it waits for one to be returned, until ctx is done. ctx also
+// bounds the dial and the active test.
+func (this *ConnectionPool) GetContext(ctx context.Context) (net.Conn, error) {
 	for {
-		select {
-		case conn := <-this.conns:
-			if conn == nil {
-				break
-				//return nil, ErrClosed
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		this.mu.Lock()
+		if this.closed {
+			this.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if this.HealthCheckInterval > 0 && this.stopCheck == nil {
+			this.stopCheck = make(chan struct{})
+			go this.maintain(this.HealthCheckInterval, this.stopCheck)
+		}
+		if n := len(this.idle); n > 0 {
+			ic := this.idle[n-1]
+			this.idle = this.idle[:n-1]
+			ic.ep.inUse++
+			this.mu.Unlock()
+			addr := ic.conn.RemoteAddr().String()
+			if this.expired(ic, time.Now()) {
+				poolEvent(this.instrumentation(), POOL_EVENT_DISCARD, addr, 0, nil)
+				this.release(ic.conn, ic.ep, true)
+				continue
 			}
-			if err := this.activeConn(conn); err != nil {
-				break
+			if this.TestOnGet {
+				if err := this.activeConn(ctx, ic.conn); err != nil {
+					poolEvent(this.instrumentation(), POOL_EVENT_ACTIVE_TEST_FAILED, addr, 0, err)
+					this.count(&ic.ep.activeTestFailures)
+					this.release(ic.conn, ic.ep, true)
+					continue
+				}
 			}
-			return this.wrapConn(conn), nil
-		default:
-			if this.Len() >= this.MaxConns {
-				return nil, fmt.Errorf("Too many connctions %d", this.Len())
-			}
-			conn, err := this.makeConn()
+			poolEvent(this.instrumentation(), POOL_EVENT_REUSE, addr, 0, nil)
+			return this.wrapConn(ic.conn, ic.ep, ic.created), nil
+		}
+		if this.open < this.MaxConns {
+			this.open++
+			this.mu.Unlock()
+			conn, ep, err := this.makeConn(ctx, true)
 			if err != nil {
+				this.release(nil, nil, false)
 				return nil, err
 			}
+			return this.wrapConn(conn, ep, time.Now()), nil
+		}
 
-			return this.wrapConn(conn), nil
+		wait := make(chan struct{}, 1)
+		this.waiters = append(this.waiters, wait)
+		this.mu.Unlock()
+		poolEvent(this.instrumentation(), POOL_EVENT_EXHAUSTED, "", 0, nil)
+		waitStart := time.Now()
+		select {
+		case <-wait:
+			this.mu.Lock()
+			this.waitCount++
+			this.waitDuration += time.Since(waitStart)
+			this.mu.Unlock()
+		case <-ctx.Done():
+			this.mu.Lock()
+			this.waitCount++
+			this.waitDuration += time.Since(waitStart)
+			for i, w := range this.waiters {
+				if w == wait {
+					this.waiters = append(this.waiters[:i], this.waiters[i+1:]...)
+					break
+				}
+			}
+			// a connection freed for this Get goes to the next one
+			select {
+			case <-wait:
+				this.notify()
+			default:
+			}
+			this.mu.Unlock()
+			return nil, ctx.Err()
 		}
 	}
-
 }
 
+// Close closes the idle connections and fails the waiting Gets, the
+// connections in use are closed when they are returned
 func (this *ConnectionPool) Close() {
-	conns := this.conns
-	this.conns = nil
-
-	if conns == nil {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
 		return
 	}
+	this.closed = true
+	idle := this.idle
+	this.idle = nil
+	this.open -= len(idle)
+	for _, ic := range idle {
+		ic.ep.open--
+	}
+	for _, wait := range this.waiters {
+		wait <- struct{}{}
+	}
+	this.waiters = nil
+	if this.stopCheck != nil {
+		close(this.stopCheck)
+	}
+	this.mu.Unlock()
 
-	close(conns)
-
-	for conn := range conns {
-		conn.Close()
+	for _, ic := range idle {
+		ic.conn.Close()
 	}
 }
 
+// Len returns the number of idle connections
 func (this *ConnectionPool) Len() int {
-	return len(this.conns)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.idle)
 }
 
-func (this *ConnectionPool) makeConn() (net.Conn, error) {
-	host := this.Hosts[rand.Intn(len(this.Hosts))]
-	addr := fmt.Sprintf("%s:%d", host, this.Port)
-	return net.DialTimeout("tcp", addr, time.Minute)
+// makeConn dials a server picked by the Selector, the next one is tried after
+// a failure. A server that can not be dialed is put in quarantine.
+func (this *ConnectionPool) makeConn(ctx context.Context, inUse bool) (net.Conn, *endpoint, error) {
+	var (
+		tried []*endpoint
+		err   error
+	)
+	for {
+		this.mu.Lock()
+		ep := this.pickEndpoint(time.Now(), tried)
+		this.mu.Unlock()
+		if ep == nil {
+			return nil, nil, err
+		}
+		tried = append(tried, ep)
+
+		start := time.Now()
+		var conn net.Conn
+		conn, err = dialContext(ctx, ep.addr, this.ConnectTimeout)
+		poolEvent(this.instrumentation(), POOL_EVENT_DIAL, ep.addr, time.Since(start), err)
+		this.mu.Lock()
+		ep.dials++
+		if err == nil {
+			ep.failures = 0
+			ep.downUntil = time.Time{}
+			ep.open++
+			if inUse {
+				ep.inUse++
+			}
+			this.mu.Unlock()
+			return conn, ep, nil
+		}
+		ep.dialFailures++
+		if ctx.Err() != nil {
+			this.mu.Unlock()
+			return nil, nil, err
+		}
+		ep.failures++
+		if this.QuarantineTime > 0 {
+			ep.downUntil = time.Now().Add(this.QuarantineTime)
+		}
+		this.mu.Unlock()
+	}
 }
 
-func (this *ConnectionPool) put(conn net.Conn) error {
-	if conn == nil {
-		return errors.New("connection is nil")
+// pickEndpoint returns the server of a new connection, or nil if every server
+// is tried. The servers in quarantine are left to the Selector only if all of
+// them are, then the one leaving it first is probed. this.mu must be held.
+func (this *ConnectionPool) pickEndpoint(now time.Time, tried []*endpoint) *endpoint {
+	var (
+		candidates []*endpoint
+		states     []ServerState
+		probe      *endpoint
+	)
+next:
+	for _, ep := range this.endpoints {
+		for _, t := range tried {
+			if t == ep {
+				continue next
+			}
+		}
+		if now.Before(ep.downUntil) {
+			if probe == nil || ep.downUntil.Before(probe.downUntil) {
+				probe = ep
+			}
+			continue
+		}
+		candidates = append(candidates, ep)
+		states = append(states, ServerState{Addr: ep.addr, InUse: ep.inUse, Open: ep.open})
+	}
+	if len(candidates) == 0 {
+		return probe
+	}
+	var selector Selector = RandomSelector{}
+	if this.Selector != nil {
+		selector = this.Selector
+	}
+	if i := selector.Select(states); i >= 0 && i < len(candidates) {
+		return candidates[i]
 	}
-	if this.conns == nil {
-		return conn.Close()
+	return candidates[0]
+}
+
+// put returns a healthy connection to the pool, it is closed if the pool has
+// enough idle connections, is closed, or if the connection is too old
+func (this *ConnectionPool) put(conn net.Conn, ep *endpoint, created time.Time) error {
+	now := time.Now()
+	this.mu.Lock()
+	if !this.closed && len(this.idle) < this.maxIdle &&
+		(this.MaxLifetime <= 0 || now.Sub(created) < this.MaxLifetime) {
+		this.idle = append(this.idle, idleConn{conn: conn, ep: ep, created: created, idleAt: now, checked: now})
+		ep.inUse--
+		this.notify()
+		this.mu.Unlock()
+		return nil
 	}
+	closed := this.closed
+	this.mu.Unlock()
+	if !closed {
+		poolEvent(this.instrumentation(), POOL_EVENT_DISCARD, conn.RemoteAddr().String(), 0, nil)
+	}
+	return this.release(conn, ep, true)
+}
 
-	select {
-	case this.conns <- conn:
+// release closes conn, if not nil, and frees its place in the pool. ep is the
+// server of conn, inUse tells whether conn is in use or idle.
+func (this *ConnectionPool) release(conn net.Conn, ep *endpoint, inUse bool) error {
+	this.mu.Lock()
+	this.open--
+	if ep != nil {
+		ep.open--
+		if inUse {
+			ep.inUse--
+		}
+	}
+	this.notify()
+	this.mu.Unlock()
+	if conn == nil {
 		return nil
-	default:
-		return conn.Close()
+	}
+	return conn.Close()
+}
+
+// count increments a counter of PoolStats
+func (this *ConnectionPool) count(counter *int64) {
+	this.mu.Lock()
+	*counter++
+	this.mu.Unlock()
+}
+
+// notify wakes up the first waiting Get, this.mu must be held
+func (this *ConnectionPool) notify() {
+	if len(this.waiters) > 0 {
+		this.waiters[0] <- struct{}{}
+		this.waiters = this.waiters[1:]
+	}
+}
+
+// expired reports whether an idle connection has to be closed
+func (this *ConnectionPool) expired(ic idleConn, now time.Time) bool {
+	return (this.IdleTimeout > 0 && now.Sub(ic.idleAt) >= this.IdleTimeout) ||
+		(this.MaxLifetime > 0 && now.Sub(ic.created) >= this.MaxLifetime)
+}
+
+func (this *ConnectionPool) maintain(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			this.check(interval)
+		}
+	}
+}
+
+// check closes the expired idle connections, pings the ones not used for an
+// interval and dials connections up to MinConns
+func (this *ConnectionPool) check(interval time.Duration) {
+	now := time.Now()
+	var stale, ping []idleConn
+	this.mu.Lock()
+	kept := this.idle[:0]
+	for _, ic := range this.idle {
+		switch {
+		case this.expired(ic, now):
+			stale = append(stale, ic)
+		// half an interval, so that a connection checked just before the
+		// last tick is not left for two intervals
+		case now.Sub(ic.checked) >= interval/2:
+			ping = append(ping, ic)
+		default:
+			kept = append(kept, ic)
+			continue
+		}
+		// the connections taken out of the idle list are in use by the check
+		ic.ep.inUse++
+	}
+	this.idle = kept
+	this.mu.Unlock()
+
+	for _, ic := range stale {
+		poolEvent(this.instrumentation(), POOL_EVENT_DISCARD, ic.conn.RemoteAddr().String(), 0, nil)
+		this.release(ic.conn, ic.ep, true)
+	}
+	alive := ping[:0]
+	for _, ic := range ping {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := this.activeConn(ctx, ic.conn)
+		cancel()
+		if err != nil {
+			poolEvent(this.instrumentation(), POOL_EVENT_ACTIVE_TEST_FAILED, ic.conn.RemoteAddr().String(), 0, err)
+			this.count(&ic.ep.activeTestFailures)
+			this.release(ic.conn, ic.ep, true)
+			continue
+		}
+		ic.checked = time.Now()
+		alive = append(alive, ic)
+	}
+
+	// the pinged connections are older than the ones returned meanwhile
+	this.mu.Lock()
+	n := len(alive)
+	if this.closed {
+		n = 0
+	} else if room := this.maxIdle - len(this.idle); n > room {
+		n = room
+	}
+	this.idle = append(append([]idleConn(nil), alive[len(alive)-n:]...), this.idle...)
+	for _, ic := range alive[len(alive)-n:] {
+		ic.ep.inUse--
+		this.notify()
+	}
+	this.mu.Unlock()
+	for _, ic := range alive[:len(alive)-n] {
+		this.release(ic.conn, ic.ep, true)
+	}
+	this.fill()
+}
+
+// fill dials connections until the pool has MinConns connections
+func (this *ConnectionPool) fill() error {
+	for {
+		this.mu.Lock()
+		if this.closed || this.open >= this.MinConns || this.open >= this.MaxConns {
+			this.mu.Unlock()
+			return nil
+		}
+		this.open++
+		this.mu.Unlock()
+		conn, ep, err := this.makeConn(context.Background(), false)
+		if err != nil {
+			this.release(nil, nil, false)
+			return err
+		}
+		now := time.Now()
+		this.mu.Lock()
+		if this.closed || len(this.idle) >= this.maxIdle {
+			this.mu.Unlock()
+			this.release(conn, ep, false)
+			continue
+		}
+		this.idle = append(this.idle, idleConn{conn: conn, ep: ep, created: now, idleAt: now, checked: now})
+		this.notify()
+		this.mu.Unlock()
 	}
 }
 
-func (this *ConnectionPool) wrapConn(conn net.Conn) net.Conn {
-	c := PoolConn{pool: this}
+// SetInstrumentation sets the Instrumentation of a pool that may be in use
+func (this *ConnectionPool) SetInstrumentation(inst Instrumentation) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.Instrumentation = inst
+}
+
+func (this *ConnectionPool) instrumentation() Instrumentation {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.Instrumentation
+}
+
+func (this *ConnectionPool) wrapConn(conn net.Conn, ep *endpoint, created time.Time) net.Conn {
+	c := PoolConn{pool: this, ep: ep, timeout: this.NetworkTimeout, created: created}
 	c.Conn = conn
 	return &c
 }
 
-func (this *ConnectionPool) activeConn(conn net.Conn) error {
+// activeConn pings an idle connection. The ping is bounded by NetworkTimeout,
+// or ConnectTimeout if it is 0, as the connection is not wrapped yet.
+func (this *ConnectionPool) activeConn(ctx context.Context, conn net.Conn) (err error) {
+	timeout := this.NetworkTimeout
+	if timeout <= 0 {
+		timeout = this.ConnectTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
 	th := &TrackerHeader{}
 	th.Cmd = FDFS_PROTO_CMD_ACTIVE_TEST
-	th.sendHeader(conn)
-	th.recvHeader(conn)
-	if th.Cmd == 100 && th.Status == 0 {
-		return nil
+	err = th.sendHeader(conn)
+	if err != nil {
+		return err
+	}
+	return th.recvResponse(conn, 0, 0)
+}
+
+func dialContext(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// watchContext applies the deadline of ctx to conn and interrupts any pending
+// io on conn once ctx is done. The returned function must be called when the
+// request on conn has finished, it returns ctx.Err() for an interrupted request
+// and marks the connection so that it is closed instead of reused. A request
+// that failed with anything else than an Errno is likely not fully sent or
+// read, its connection is not reused either.
+func watchContext(ctx context.Context, conn net.Conn) func(err error) error {
+	pc, _ := conn.(*PoolConn)
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if pc != nil {
+			pc.setRequestDeadline(deadline)
+		} else {
+			conn.SetDeadline(deadline)
+		}
+	}
+	done := ctx.Done()
+	if done == nil {
+		return func(err error) error {
+			poisonConn(conn, err)
+			return err
+		}
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-done:
+			if pc != nil {
+				pc.interrupt()
+			} else {
+				conn.SetDeadline(aLongTimeAgo)
+			}
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	return func(err error) error {
+		close(stop)
+		if <-interrupted {
+			discardConn(conn, ctx.Err())
+			return ctx.Err()
+		}
+		if err != nil && hasDeadline && !time.Now().Before(deadline) {
+			discardConn(conn, context.DeadlineExceeded)
+			return context.DeadlineExceeded
+		}
+		if hasDeadline {
+			if pc != nil {
+				pc.setRequestDeadline(time.Time{})
+			} else {
+				conn.SetDeadline(time.Time{})
+			}
+		}
+		poisonConn(conn, err)
+		return err
+	}
+}
+
+// poisonConn discards conn after a failed request, unless the server answered
+// it with an Errno in a well formed response
+func poisonConn(conn net.Conn, err error) {
+	var errno Errno
+	if err != nil && !errors.As(err, &errno) {
+		discardConn(conn, err)
+	}
+}
+
+// discardConn makes sure conn is closed rather than put back into its pool
+func discardConn(conn net.Conn, err error) {
+	if pc, ok := conn.(*PoolConn); ok && pc.lastErr == nil {
+		pc.lastErr = err
 	}
-	return errors.New("Conn unaliviable")
 }
 
 func TcpRecvResponse(conn net.Conn, bufferSize int64) ([]byte, int64, error) {
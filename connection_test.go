@@ -1,8 +1,17 @@
 package fdfs_client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
 )
 
 func getConn(pool *ConnectionPool) {
@@ -18,8 +27,8 @@ func getConn(pool *ConnectionPool) {
 }
 
 func TestGetConnection(t *testing.T) {
-	hosts := []string{"192.168.199.2"}
-	port := 22122
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	hosts := []string{host}
 	minConns := 10
 	maxConns := 150
 	pool, err := NewConnectionPool(hosts, port, minConns, maxConns)
@@ -33,8 +42,8 @@ func TestGetConnection(t *testing.T) {
 }
 
 func BenchmarkGetConnection(b *testing.B) {
-	hosts := []string{"192.168.199.2"}
-	port := 22122
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	hosts := []string{host}
 	minConns := 10
 	maxConns := 150
 	pool, err := NewConnectionPool(hosts, port, minConns, maxConns)
@@ -48,3 +57,445 @@ func BenchmarkGetConnection(b *testing.B) {
 		go getConn(pool)
 	}
 }
+
+func TestWatchContextCancel(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := &PoolConn{Conn: c1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finish := watchContext(ctx, conn)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := conn.Read(make([]byte, 10))
+	if err == nil {
+		t.Fatal("read should be interrupted")
+	}
+	if err = finish(err); err != context.Canceled {
+		t.Fatalf("finish returns %v, expect context.Canceled", err)
+	}
+	if conn.lastErr == nil {
+		t.Fatal("interrupted connection should not be reused")
+	}
+	conn.Close()
+}
+
+func TestStorageDeadline(t *testing.T) {
+	// a storage that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	store := StorageClient{IpAddr: addr.IP.String(), Port: addr.Port, GroupName: "group1"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = store.DownloadExContext(ctx, "M00/00/00/test.txt", io.Discard, 0, 0)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("DownloadExContext returns %v, expect context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("DownloadExContext does not respect the deadline")
+	}
+}
+
+func TestStoragePoolReuse(t *testing.T) {
+	// a storage that only answers FDFS_PROTO_CMD_ACTIVE_TEST
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				th := &TrackerHeader{}
+				buf := make([]byte, 10)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					if th.Unmarshal(buf); th.Cmd != FDFS_PROTO_CMD_ACTIVE_TEST {
+						return
+					}
+					resp := &TrackerHeader{Cmd: TRACKER_PROTO_CMD_RESP}
+					resp.sendHeader(conn)
+				}
+			}()
+		}
+	}()
+
+	pool, err := NewStoragePool(2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	for i := 0; i < 5; i++ {
+		conn, err := pool.Get(ln.Addr().String())
+		if err != nil {
+			t.Fatal("StoragePool.Get error:", err)
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("storage connection dialed %d times, expect 1", n)
+	}
+}
+
+func TestConnectionPoolWait(t *testing.T) {
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	pool, err := NewConnectionPool([]string{host}, port, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = pool.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("GetContext returns %v, expect context.DeadlineExceeded", err)
+	}
+
+	got := make(chan error)
+	go func() {
+		conn, err := pool.Get()
+		if err == nil {
+			conn.Close()
+		}
+		got <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	if err = <-got; err != nil {
+		t.Fatal("waiting Get returns", err)
+	}
+	if err = conn.Close(); err == nil {
+		t.Fatal("second Close of a connection succeeds")
+	}
+	if pool.Len() != 1 || pool.open != 1 {
+		t.Fatalf("pool has %d idle and %d open connections, expect 1 and 1", pool.Len(), pool.open)
+	}
+}
+
+func TestConnectionPoolClose(t *testing.T) {
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	pool, err := NewConnectionPool([]string{host}, port, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				conn, err := pool.Get()
+				if err != nil {
+					if err != ErrClosed {
+						t.Error("Get returns", err)
+					}
+					return
+				}
+				time.Sleep(time.Millisecond)
+				conn.Close()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	pool.Close()
+	wg.Wait()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.open != 0 || len(pool.idle) != 0 || len(pool.waiters) != 0 {
+		t.Fatalf("closed pool has %d open, %d idle connections and %d waiters",
+			pool.open, len(pool.idle), len(pool.waiters))
+	}
+}
+
+func TestConnectionPoolExpire(t *testing.T) {
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	pool, err := NewConnectionPool([]string{host}, port, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	metrics := NewMetrics()
+	pool.Instrumentation = metrics
+	pool.IdleTimeout = 50 * time.Millisecond
+	pool.MaxLifetime = 200 * time.Millisecond
+	dials := func() int64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.events[metricsKey{"dial", cluster.TrackerAddr()}]
+	}
+
+	conn, _ := pool.Get()
+	conn.Close()
+	conn, _ = pool.Get()
+	conn.Close()
+	if n := dials(); n != 1 {
+		t.Fatalf("%d dials, expect 1", n)
+	}
+	time.Sleep(80 * time.Millisecond)
+	conn, _ = pool.Get()
+	if n := dials(); n != 2 {
+		t.Fatalf("%d dials after the idle timeout, expect 2", n)
+	}
+	// the connection is too old to be put back
+	time.Sleep(250 * time.Millisecond)
+	conn.Close()
+	if pool.Len() != 0 {
+		t.Fatalf("pool keeps %d connections older than MaxLifetime", pool.Len())
+	}
+}
+
+func TestConnectionPoolActiveTestTimeout(t *testing.T) {
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	pool, err := NewConnectionPool([]string{host}, port, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.NetworkTimeout = 50 * time.Millisecond
+	pool.TestOnGet = true
+	dials := func() int64 {
+		return pool.Stats().Servers[0].Dials
+	}
+
+	// a request arms the deadline of the socket, which expires while idle
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := &TrackerHeader{Cmd: FDFS_PROTO_CMD_ACTIVE_TEST}
+	if err = th.sendHeader(conn); err == nil {
+		err = th.recvResponse(conn, 0, 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	time.Sleep(80 * time.Millisecond)
+	conn, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := dials(); n != 1 {
+		t.Fatalf("%d dials after idling past NetworkTimeout, expect 1", n)
+	}
+
+	// a server that does not answer the ping does not block Get
+	tracker := cluster.Tracker
+	tracker.Inject(fdfstest.Fault{Cmd: FDFS_PROTO_CMD_ACTIVE_TEST, Delay: time.Second, Times: 1})
+	defer tracker.ClearFaults()
+	start := time.Now()
+	conn, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("Get takes %v with an unanswered ping", d)
+	}
+	if n := pool.Stats().Servers[0].ActiveTestFailures; n != 1 {
+		t.Fatalf("%d active tests failed, expect 1", n)
+	}
+}
+
+func TestConnectionPoolHealthCheck(t *testing.T) {
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	pool, err := NewConnectionPool([]string{host}, port, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	metrics := NewMetrics()
+	pool.Instrumentation = metrics
+	pool.HealthCheckInterval = 20 * time.Millisecond
+	pool.TestOnGet = false
+	events := func(name string) int64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.events[metricsKey{name, cluster.TrackerAddr()}]
+	}
+
+	tracker := cluster.Tracker
+	pings := tracker.Requests(FDFS_PROTO_CMD_ACTIVE_TEST)
+	// the first Get starts the checks, without any active test
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := tracker.Requests(FDFS_PROTO_CMD_ACTIVE_TEST); n != pings {
+		t.Fatalf("Get sends %d active tests, expect none", n-pings)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if n := tracker.Requests(FDFS_PROTO_CMD_ACTIVE_TEST); n == pings {
+		t.Fatal("idle connections are not pinged")
+	}
+
+	// the pings fail, the connections are replaced up to MinConns
+	tracker.Inject(fdfstest.Fault{Cmd: FDFS_PROTO_CMD_ACTIVE_TEST, Drop: true, Times: 2})
+	defer tracker.ClearFaults()
+	deadline := time.Now().Add(time.Second)
+	for events("active_test_failed") < 2 || events("dial") < 2 || pool.Len() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active tests failed, %d dials, %d idle connections, expect 2, 2, 2",
+				events("active_test_failed"), events("dial"), pool.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pool.mu.Lock()
+	open := pool.open
+	pool.mu.Unlock()
+	if open != 2 {
+		t.Fatalf("pool has %d connections, expect MinConns", open)
+	}
+}
+
+func TestPoisonOnDesync(t *testing.T) {
+	// a tracker that answers every request with the next response
+	responses := make(chan []byte, 10)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 10)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					th := &TrackerHeader{}
+					th.Unmarshal(buf)
+					if _, err := io.CopyN(io.Discard, conn, th.PkgLen); err != nil {
+						return
+					}
+					conn.Write(<-responses)
+				}
+			}()
+		}
+	}()
+	response := func(pkgLen int, cmd int8, status int8, bodyLen int) []byte {
+		header, _ := (&TrackerHeader{PkgLen: int64(pkgLen), Cmd: cmd, Status: status}).Marshal()
+		return append(header, make([]byte, bodyLen)...)
+	}
+
+	pool, err := NewConnectionPoolWithAddrs([]string{ln.Addr().String()}, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.TestOnGet = false
+	tc := &TrackerClient{Pool: pool}
+
+	tests := []struct {
+		name     string
+		response []byte
+		target   error
+		poisoned bool
+	}{
+		{"wrong cmd", response(TRACKER_QUERY_STORAGE_STORE_BODY_LEN, 99, 0, TRACKER_QUERY_STORAGE_STORE_BODY_LEN), ErrProtocol, true},
+		{"short body", response(TRACKER_QUERY_STORAGE_STORE_BODY_LEN-1, TRACKER_PROTO_CMD_RESP, 0, TRACKER_QUERY_STORAGE_STORE_BODY_LEN-1), ErrProtocol, true},
+		{"status with body", response(5, TRACKER_PROTO_CMD_RESP, 2, 5), ErrNotFound, true},
+		{"status", response(0, TRACKER_PROTO_CMD_RESP, 2, 0), ErrNotFound, false},
+	}
+	var errorCloses int64
+	for _, tt := range tests {
+		responses <- tt.response
+		_, err := tc.QueryStorageStoreWithoutGroup()
+		if !errors.Is(err, tt.target) {
+			t.Fatalf("%s: QueryStorageStoreWithoutGroup returns %v, expect %v", tt.name, err, tt.target)
+		}
+		if tt.poisoned {
+			errorCloses++
+		}
+		s := pool.Stats().Servers[0]
+		if s.ErrorCloses != errorCloses || s.InUse != 0 {
+			t.Fatalf("%s: %d error closes, %d in use, expect %d, 0", tt.name, s.ErrorCloses, s.InUse, errorCloses)
+		}
+		if poisoned := s.Idle == 0; poisoned != tt.poisoned {
+			t.Fatalf("%s: connection poisoned %v, expect %v", tt.name, poisoned, tt.poisoned)
+		}
+	}
+
+	// a body that can't be decoded is reported with the tracker address
+	responses <- response(TRACKER_GROUP_STAT_SIZE-1, TRACKER_PROTO_CMD_RESP, 0, TRACKER_GROUP_STAT_SIZE-1)
+	_, err = tc.ListGroups()
+	var oe *OpError
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &oe) || oe.Addr != ln.Addr().String() {
+		t.Fatalf("ListGroups returns %v, expect an ErrProtocol from %s", err, ln.Addr())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestPoisonOnAbortedDownload(t *testing.T) {
+	storagePool, err := NewStoragePool(2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storagePool.Close()
+	fdfsClient := &FdfsClient{ConnPool: connPool, StoragePool: storagePool}
+	fileId, err := fdfsClient.UploadByBuffer(make([]byte, 64<<10), "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fdfsClient.DeleteFile(fileId)
+
+	// the body of the response is left unread
+	if _, err = fdfsClient.DownloadEx(fileId, failingWriter{}, 0, 0); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("DownloadEx returns %v, expect io.ErrShortWrite", err)
+	}
+	var errorCloses int64
+	for _, s := range storagePool.Stats().Servers {
+		errorCloses += s.ErrorCloses
+	}
+	if errorCloses != 1 {
+		t.Fatalf("%d connections closed after an error, expect 1", errorCloses)
+	}
+	if _, err = fdfsClient.DownloadEx(fileId, io.Discard, 0, 0); err != nil {
+		t.Fatal("download after the aborted one:", err)
+	}
+}
@@ -0,0 +1,185 @@
+package fdfs_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Errors returned by the client, use errors.Is to match them. The status
+// codes answered by trackers and storages are matched by Errno.
+var (
+	ErrNotFound        = errors.New("file not found")
+	ErrExists          = errors.New("file exists")
+	ErrNoSpace         = errors.New("no space left")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrBusy            = errors.New("server busy")
+	ErrPermission      = errors.New("permission denied")
+	ErrIO              = errors.New("server io error")
+	ErrNotSupported    = errors.New("operation not supported")
+	ErrTimeout         = errors.New("timeout")
+	// ErrUnavailable matches the servers that can't be reached, and the
+	// connections that break during a request
+	ErrUnavailable = errors.New("server unavailable")
+	// ErrProtocol is a response that does not follow the protocol
+	ErrProtocol = errors.New("protocol error")
+	// ErrModified is a file changed by someone else during an UploadSession
+	ErrModified = errors.New("file modified")
+)
+
+// the errno of the servers, FastDFS runs on linux
+var errnoErrors = map[int]error{
+	1:   ErrPermission,      // EPERM
+	2:   ErrNotFound,        // ENOENT
+	5:   ErrIO,              // EIO
+	11:  ErrBusy,            // EAGAIN
+	12:  ErrBusy,            // ENOMEM
+	13:  ErrPermission,      // EACCES
+	16:  ErrBusy,            // EBUSY
+	17:  ErrExists,          // EEXIST
+	22:  ErrInvalidArgument, // EINVAL
+	24:  ErrBusy,            // EMFILE
+	28:  ErrNoSpace,         // ENOSPC
+	38:  ErrNotSupported,    // ENOSYS
+	95:  ErrNotSupported,    // EOPNOTSUPP
+	107: ErrUnavailable,     // ENOTCONN
+	110: ErrTimeout,         // ETIMEDOUT
+	111: ErrUnavailable,     // ECONNREFUSED
+	113: ErrUnavailable,     // EHOSTUNREACH
+}
+
+// Errno is the status of a response
+type Errno struct {
+	status int
+}
+
+func (e Errno) Error() string {
+	errmsg := fmt.Sprintf("errno [%d]", e.status)
+	if err, ok := errnoErrors[e.status]; ok {
+		errmsg += " " + err.Error()
+	}
+	return errmsg
+}
+
+func (e Errno) Status() int {
+	return e.status
+}
+
+func (e Errno) Is(target error) bool {
+	return errnoErrors[e.status] == target
+}
+
+// OpError is the error of a request to a tracker or a storage
+type OpError struct {
+	// Op is the request, like "upload" or "query_fetch"
+	Op string
+	// Addr is the ip:port of the server, it is empty if unknown
+	Addr string
+	// FileId is the group/filename of the request, if any
+	FileId string
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	errmsg := "fdfs: " + e.Op
+	if e.Addr != "" {
+		errmsg += " " + e.Addr
+	}
+	if e.FileId != "" {
+		errmsg += " " + e.FileId
+	}
+	return errmsg + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the network errors to ErrTimeout and ErrUnavailable
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		var ne net.Error
+		return errors.As(e.Err, &ne) && ne.Timeout()
+	case ErrUnavailable:
+		return isBrokenConn(e.Err)
+	}
+	return false
+}
+
+// IsRetryable reports whether the request that failed with err may succeed
+// if it is sent again, possibly to another server. Cancelled requests, and
+// errors about the request itself like ErrNotFound, are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrClosed) {
+		return false
+	}
+	for _, target := range []error{ErrBusy, ErrNoSpace, ErrIO, ErrTimeout, ErrUnavailable, ErrProtocol} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	var ne net.Error
+	return isBrokenConn(err) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+func isBrokenConn(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return false
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// opError wraps err with the request it comes from. Errors already wrapped and
+// context errors are returned as is.
+func opError(cmd int8, addr string, fileId string, err error) error {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	var oe *OpError
+	if errors.As(err, &oe) {
+		return err
+	}
+	return &OpError{Op: cmdName(cmd), Addr: addr, FileId: fileId, Err: err}
+}
+
+var cmdNames = map[int8]string{
+	STORAGE_PROTO_CMD_UPLOAD_FILE:                           "upload",
+	STORAGE_PROTO_CMD_DELETE_FILE:                           "delete",
+	STORAGE_PROTO_CMD_SET_METADATA:                          "set_metadata",
+	STORAGE_PROTO_CMD_DOWNLOAD_FILE:                         "download",
+	STORAGE_PROTO_CMD_GET_METADATA:                          "get_metadata",
+	STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE:                     "upload_slave",
+	STORAGE_PROTO_CMD_QUERY_FILE_INFO:                       "query_file_info",
+	STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE:                  "upload_appender",
+	STORAGE_PROTO_CMD_APPEND_FILE:                           "append",
+	STORAGE_PROTO_CMD_MODIFY_FILE:                           "modify",
+	STORAGE_PROTO_CMD_TRUNCATE_FILE:                         "truncate",
+	STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME:          "regenerate_appender_filename",
+	TRACKER_PROTO_CMD_SERVER_LIST_ONE_GROUP:                 "list_one_group",
+	TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS:                "list_groups",
+	TRACKER_PROTO_CMD_SERVER_LIST_STORAGE:                   "list_storages",
+	TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE:                 "delete_storage",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE: "query_store",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE:               "query_fetch",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE:                  "query_update",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE:    "query_store",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL:               "query_fetch_all",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ALL: "query_store_all",
+	TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ALL:    "query_store_all",
+	FDFS_PROTO_CMD_ACTIVE_TEST:                              "active_test",
+}
+
+func cmdName(cmd int8) string {
+	if name, ok := cmdNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("cmd %d", cmd)
+}
@@ -0,0 +1,78 @@
+package fdfs_client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+func TestErrnoIs(t *testing.T) {
+	tests := []struct {
+		status int
+		target error
+	}{
+		{fdfstest.ENOENT, ErrNotFound},
+		{fdfstest.EEXIST, ErrExists},
+		{fdfstest.ENOSPC, ErrNoSpace},
+		{fdfstest.EINVAL, ErrInvalidArgument},
+		{fdfstest.EBUSY, ErrBusy},
+		{fdfstest.EIO, ErrIO},
+	}
+	for _, tt := range tests {
+		if err := (Errno{tt.status}); !errors.Is(err, tt.target) {
+			t.Errorf("%v does not match %v", err, tt.target)
+		}
+	}
+	if errors.Is(Errno{fdfstest.ENOENT}, ErrExists) {
+		t.Error("ENOENT matches ErrExists")
+	}
+	if errors.Is(Errno{200}, ErrNotFound) {
+		t.Error("unknown errno matches ErrNotFound")
+	}
+}
+
+func TestOpError(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	remoteFileId := "group1/M00/00/00/not_exists.txt"
+	err := fdfsClient.DeleteFile(remoteFileId)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteFile returns %v, expect ErrNotFound", err)
+	}
+	var oe *OpError
+	if !errors.As(err, &oe) {
+		t.Fatalf("DeleteFile returns %T, expect *OpError", err)
+	}
+	if oe.Addr != cluster.TrackerAddr() || oe.FileId != remoteFileId {
+		t.Fatalf("OpError addr %q, file id %q, expect %q, %q", oe.Addr, oe.FileId, cluster.TrackerAddr(), remoteFileId)
+	}
+	if IsRetryable(err) {
+		t.Fatal("ErrNotFound is retryable")
+	}
+
+	if err = fdfsClient.DeleteFile("not_a_file_id"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("DeleteFile returns %v, expect ErrInvalidArgument", err)
+	}
+
+	// every storage drops the upload
+	for _, s := range cluster.Storages {
+		s.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_FILE, Drop: true})
+		defer s.ClearFaults()
+	}
+	_, err = fdfsClient.UploadByBuffer([]byte("12345"), "txt")
+	if !errors.Is(err, ErrUnavailable) || !IsRetryable(err) {
+		t.Fatalf("UploadByBuffer returns %v, expect a retryable ErrUnavailable", err)
+	}
+	if !errors.As(err, &oe) || oe.Op != "upload" {
+		t.Fatalf("UploadByBuffer returns %v, expect an upload OpError", err)
+	}
+	for _, s := range cluster.Storages {
+		s.ClearFaults()
+		s.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_FILE, Status: fdfstest.ENOSPC})
+	}
+	_, err = fdfsClient.UploadByBuffer([]byte("12345"), "txt")
+	if !errors.Is(err, ErrNoSpace) || !IsRetryable(err) {
+		t.Fatalf("UploadByBuffer returns %v, expect a retryable ErrNoSpace", err)
+	}
+}
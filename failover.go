@@ -0,0 +1,238 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// uploadFunc sends input to store, input is nil for uploads that open their own file
+type uploadFunc func(store *StorageClient, input io.Reader) (*FileId, error)
+
+// upload runs fn on the storage the tracker picks. With UploadFailover, it
+// asks the tracker for every writable storage and tries them in turn, until
+// an error that is not retryable.
+func (this *FdfsClient) upload(ctx context.Context, input io.Reader, size int64, fn uploadFunc) (string, error) {
+	tc := this.trackerClient()
+	if !this.UploadFailover {
+		store, err := tc.QueryStorageStoreWithoutGroupContext(ctx)
+		if err != nil {
+			return "", err
+		}
+		fid, err := fn(store, input)
+		if err != nil {
+			return "", err
+		}
+		return fid.GetFileIdStr(), nil
+	}
+
+	stores, err := tc.QueryStorageStoreWithoutGroupAllContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	replay, err := newReplayReader(input, size, this.FailoverBufferSize)
+	if err != nil {
+		return "", err
+	}
+
+	var lastErr error
+	for _, store := range stores {
+		if !replay.rewind() {
+			// part of a non seekable input is consumed, it can not be sent again
+			break
+		}
+		fid, err := fn(store, replay.reader())
+		if err == nil {
+			return fid.GetFileIdStr(), nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		// the next storage would refuse the request too
+		if !IsRetryable(err) {
+			return "", err
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// replayReader remembers where an upload input starts, so that it can be sent
+// again to another storage
+type replayReader struct {
+	r      io.Reader
+	seeker io.Seeker
+	start  int64
+	read   int64
+}
+
+// newReplayReader wraps r, non seekable inputs up to bufferSize bytes are
+// read into memory so that they can be replayed.
+func newReplayReader(r io.Reader, size int64, bufferSize int64) (*replayReader, error) {
+	if r == nil {
+		return &replayReader{}, nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		// pipes and sockets may be *os.File but can't seek
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &replayReader{r: r, seeker: seeker, start: start}, nil
+		}
+	}
+	if size <= bufferSize {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		bb := bytes.NewReader(buf)
+		return &replayReader{r: bb, seeker: bb}, nil
+	}
+	return &replayReader{r: r}, nil
+}
+
+func (this *replayReader) Read(p []byte) (n int, err error) {
+	n, err = this.r.Read(p)
+	this.read += int64(n)
+	return
+}
+
+func (this *replayReader) reader() io.Reader {
+	if this.r == nil {
+		return nil
+	}
+	return this
+}
+
+// rewind moves back to the start of the input, it returns false if the
+// consumed bytes can't be read again.
+func (this *replayReader) rewind() bool {
+	if this.read == 0 {
+		return true
+	}
+	if this.seeker == nil {
+		return false
+	}
+	if _, err := this.seeker.Seek(this.start, io.SeekStart); err != nil {
+		return false
+	}
+	this.read = 0
+	return true
+}
+
+// download reads remoteFilename from the storage the tracker picks. With
+// DownloadFailover or HedgeDelay, it asks the tracker for every replica.
+func (this *FdfsClient) download(ctx context.Context, fid *FileId, output io.Writer, offset int64, downloadSize int64) (int64, error) {
+	tc := this.trackerClient()
+	if !this.DownloadFailover && this.HedgeDelay <= 0 {
+		store, err := tc.QueryStorageFetchContext(ctx, fid)
+		if err != nil {
+			return 0, err
+		}
+		return store.DownloadExContext(ctx, fid.FileName, output, offset, downloadSize)
+	}
+
+	stores, err := tc.QueryStorageFetchAllContext(ctx, fid)
+	if err != nil {
+		return 0, err
+	}
+	if this.HedgeDelay > 0 && len(stores) > 1 {
+		return hedgedDownload(ctx, stores, fid.FileName, output, offset, downloadSize, this.HedgeDelay)
+	}
+	return failoverDownload(ctx, stores, fid.FileName, output, offset, downloadSize)
+}
+
+// failoverDownload tries the replicas in turn until an error that is not
+// retryable, a replica continues where the previous one failed so output
+// never gets a byte twice.
+func failoverDownload(ctx context.Context, stores []*StorageClient, remoteFilename string,
+	output io.Writer, offset int64, downloadSize int64) (int64, error) {
+	var (
+		total   int64
+		lastErr error
+	)
+	for _, store := range stores {
+		remain := int64(0)
+		if downloadSize > 0 {
+			remain = downloadSize - total
+		}
+		n, err := store.DownloadExContext(ctx, remoteFilename, output, offset+total, remain)
+		total += n
+		if err == nil {
+			return total, nil
+		}
+		if ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+		if !IsRetryable(err) {
+			return total, err
+		}
+		lastErr = err
+	}
+	return total, lastErr
+}
+
+// hedgedDownload starts with the first replica and adds the next one every
+// delay, or as soon as an attempt fails. The first complete response wins and
+// the others are cancelled. Responses are buffered in memory, so hedging is
+// meant for small files and ranges.
+func hedgedDownload(ctx context.Context, stores []*StorageClient, remoteFilename string,
+	output io.Writer, offset int64, downloadSize int64, delay time.Duration) (int64, error) {
+	type result struct {
+		buf *bytes.Buffer
+		err error
+	}
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(stores))
+	next, pending := 0, 0
+	launch := func() {
+		store := stores[next]
+		next++
+		pending++
+		go func() {
+			buf := &bytes.Buffer{}
+			_, err := store.DownloadExContext(attemptCtx, remoteFilename, buf, offset, downloadSize)
+			results <- result{buf, err}
+		}()
+	}
+
+	hedge := time.NewTimer(delay)
+	defer hedge.Stop()
+	resetHedge := func() {
+		if !hedge.Stop() {
+			select {
+			case <-hedge.C:
+			default:
+			}
+		}
+		hedge.Reset(delay)
+	}
+
+	var lastErr error
+	launch()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				return io.Copy(output, r.buf)
+			}
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			lastErr = r.err
+			if next < len(stores) {
+				launch()
+				resetHedge()
+			}
+		case <-hedge.C:
+			if next < len(stores) {
+				launch()
+				hedge.Reset(delay)
+			}
+		}
+	}
+	return 0, lastErr
+}
@@ -3,9 +3,12 @@ package fdfs_client
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
@@ -82,6 +85,8 @@ const (
 	STORAGE_PROTO_CMD_TRUNCATE_FILE      = 36 //since V3.08
 	STORAGE_PROTO_CMD_SYNC_TRUNCATE_FILE = 37 //since V3.08
 
+	STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME = 38 //since V6.02
+
 	//for overwrite all old metadata
 	STORAGE_SET_METADATA_FLAG_OVERWRITE     = 'O'
 	STORAGE_SET_METADATA_FLAG_OVERWRITE_STR = "O"
@@ -103,6 +108,7 @@ const (
 	FDFS_MAX_GROUPS             = 512
 	FDFS_MAX_TRACKERS           = 16
 	FDFS_DOMAIN_NAME_MAX_LEN    = 128
+	FDFS_STORAGE_ID_MAX_SIZE    = 16
 
 	FDFS_MAX_META_NAME_LEN  = 64
 	FDFS_MAX_META_VALUE_LEN = 256
@@ -124,6 +130,7 @@ const (
 
 	TRACKER_QUERY_STORAGE_FETCH_BODY_LEN = (FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE)
 	TRACKER_QUERY_STORAGE_STORE_BODY_LEN = (FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE + 1)
+	STORAGE_QUERY_FILE_INFO_BODY_LEN     = (FDFS_PROTO_PKG_LEN_SIZE*3 + IP_ADDRESS_SIZE)
 	//status code, order is important!
 	FDFS_STORAGE_STATUS_INIT       = 0
 	FDFS_STORAGE_STATUS_WAIT_SYNC  = 1
@@ -149,6 +156,9 @@ type RequestResponse interface {
 	Response
 }
 
+// MAX_RESPONSE_BODY_LEN bounds the responses, except for file downloads
+const MAX_RESPONSE_BODY_LEN = 64 << 20
+
 type TrackerHeader struct {
 	PkgLen int64
 	Cmd    int8
@@ -165,7 +175,7 @@ func (this *TrackerHeader) Marshal() ([]byte, error) {
 
 func (this *TrackerHeader) Unmarshal(data []byte) error {
 	if len(data) != 10 {
-		return errors.New("data less than 10")
+		return fmt.Errorf("%w: header length %d, expect 10", ErrProtocol, len(data))
 	}
 	buff := bytes.NewBuffer(data)
 	binary.Read(buff, binary.BigEndian, &this.PkgLen)
@@ -176,19 +186,52 @@ func (this *TrackerHeader) Unmarshal(data []byte) error {
 	return nil
 }
 
-func (this *TrackerHeader) sendHeader(conn net.Conn) {
-	buf, _ := this.Marshal()
-	conn.Write(buf)
+func (this *TrackerHeader) sendHeader(conn net.Conn) error {
+	buf, err := this.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
 }
 
-func (this *TrackerHeader) recvHeader(conn net.Conn) {
+// recvHeader reads the header of a response. A header that is not a response
+// poisons conn, it is closed instead of being reused.
+func (this *TrackerHeader) recvHeader(conn net.Conn) error {
 	buf := make([]byte, 10)
-	_, err := io.ReadFull(conn, buf)
-	if err != nil {
-		return
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		discardConn(conn, err)
+		return err
+	}
+	this.Unmarshal(buf)
+	if this.Cmd != TRACKER_PROTO_CMD_RESP || this.PkgLen < 0 {
+		err := fmt.Errorf("%w: response cmd %d, length %d", ErrProtocol, this.Cmd, this.PkgLen)
+		discardConn(conn, err)
+		return err
 	}
+	return nil
+}
 
-	err = this.Unmarshal(buf)
+// recvResponse reads the header of a response, it returns the Errno of a
+// failed request and checks that the body is minLen to maxLen bytes long.
+// Any inconsistency poisons conn, as the bytes left unread would be taken
+// for the next response.
+func (this *TrackerHeader) recvResponse(conn net.Conn, minLen int64, maxLen int64) error {
+	if err := this.recvHeader(conn); err != nil {
+		return err
+	}
+	if this.Status != 0 {
+		if this.PkgLen != 0 {
+			discardConn(conn, fmt.Errorf("%w: failed response with a body", ErrProtocol))
+		}
+		return Errno{int(this.Status)}
+	}
+	if this.PkgLen < minLen || this.PkgLen > maxLen {
+		err := fmt.Errorf("%w: response length %d, expect %d to %d", ErrProtocol, this.PkgLen, minLen, maxLen)
+		discardConn(conn, err)
+		return err
+	}
+	return nil
 }
 
 type UploadFileRequest struct {
@@ -230,6 +273,124 @@ func (this *UploadSlaveFileRequest) Marshal() ([]byte, error) {
 	return buf, nil
 }
 
+type AppendFileRequest struct {
+	FileSize         int64
+	AppenderFilename string
+}
+
+// #append_fmt |-appender_filename_len(8)-file_size(8)-appender_filename(len)-|
+func (this *AppendFileRequest) Marshal() ([]byte, error) {
+	buf := make([]byte, 8+8+len(this.AppenderFilename))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(this.AppenderFilename)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(this.FileSize))
+	copy(buf[16:], this.AppenderFilename)
+	return buf, nil
+}
+
+type ModifyFileRequest struct {
+	FileOffset       int64
+	FileSize         int64
+	AppenderFilename string
+}
+
+// #modify_fmt |-appender_filename_len(8)-file_offset(8)-file_size(8)
+// #            -appender_filename(len)-|
+func (this *ModifyFileRequest) Marshal() ([]byte, error) {
+	buf := make([]byte, 8+8+8+len(this.AppenderFilename))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(this.AppenderFilename)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(this.FileOffset))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(this.FileSize))
+	copy(buf[24:], this.AppenderFilename)
+	return buf, nil
+}
+
+type TruncateFileRequest struct {
+	TruncatedFileSize int64
+	AppenderFilename  string
+}
+
+// #truncate_fmt |-appender_filename_len(8)-truncated_file_size(8)-appender_filename(len)-|
+func (this *TruncateFileRequest) Marshal() ([]byte, error) {
+	buf := make([]byte, 8+8+len(this.AppenderFilename))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(this.AppenderFilename)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(this.TruncatedFileSize))
+	copy(buf[16:], this.AppenderFilename)
+	return buf, nil
+}
+
+type SetMetadataRequest struct {
+	Flag      byte
+	GroupName string
+	FileName  string
+	Metadata  map[string]string
+}
+
+// #meta_fmt |-filename_len(8)-meta_len(8)-op_flag(1)-group_name(16)
+// #          -filename(filename_len)-meta(meta_len)-|
+func (this *SetMetadataRequest) Marshal() ([]byte, error) {
+	if this.Flag != STORAGE_SET_METADATA_FLAG_OVERWRITE && this.Flag != STORAGE_SET_METADATA_FLAG_MERGE {
+		return nil, fmt.Errorf("%w: metadata flag %q", ErrInvalidArgument, this.Flag)
+	}
+	meta, err := marshalMetadata(this.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8+8+1+16+len(this.FileName)+len(meta))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(this.FileName)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(len(meta)))
+	buf[16] = this.Flag
+	// 16 bit groupName
+	copy(buf[17:33], this.GroupName)
+	copy(buf[33:], this.FileName)
+	copy(buf[33+len(this.FileName):], meta)
+	return buf, nil
+}
+
+// metadata is stored as name FDFS_FIELD_SEPERATOR value records, joined by FDFS_RECORD_SEPERATOR
+func marshalMetadata(metadata map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(metadata))
+	for name, value := range metadata {
+		if len(name) == 0 || len(name) > FDFS_MAX_META_NAME_LEN {
+			return nil, fmt.Errorf("%w: metadata name %q, length must be 1 to %d", ErrInvalidArgument, name, FDFS_MAX_META_NAME_LEN)
+		}
+		if len(value) > FDFS_MAX_META_VALUE_LEN {
+			return nil, fmt.Errorf("%w: metadata value of %q too long, max length is %d", ErrInvalidArgument, name, FDFS_MAX_META_VALUE_LEN)
+		}
+		if strings.ContainsAny(name+value, string([]byte{FDFS_RECORD_SEPERATOR, FDFS_FIELD_SEPERATOR})) {
+			return nil, fmt.Errorf("%w: metadata %q contains separator characters", ErrInvalidArgument, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(FDFS_RECORD_SEPERATOR)
+		}
+		buf.WriteString(name)
+		buf.WriteByte(FDFS_FIELD_SEPERATOR)
+		buf.WriteString(metadata[name])
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalMetadata(data []byte) map[string]string {
+	metadata := make(map[string]string)
+	if len(data) == 0 {
+		return metadata
+	}
+	for _, record := range bytes.Split(data, []byte{FDFS_RECORD_SEPERATOR}) {
+		fields := bytes.SplitN(record, []byte{FDFS_FIELD_SEPERATOR}, 2)
+		if len(fields) == 2 {
+			metadata[string(fields[0])] = string(fields[1])
+		} else {
+			metadata[string(fields[0])] = ""
+		}
+	}
+	return metadata
+}
+
 type FileId struct {
 	GroupName string
 	FileName  string
@@ -238,7 +399,7 @@ type FileId struct {
 // recv_fmt: |-group_name(16)-remote_file_name(recv_size - 16)-|
 func (fid *FileId) Unmarshal(data []byte) error {
 	if len(data) < FDFS_GROUP_NAME_MAX_LEN {
-		return Errno{255}
+		return fmt.Errorf("%w: file id length %d", ErrProtocol, len(data))
 	}
 	fid.GroupName = TrimCStr(data[:FDFS_GROUP_NAME_MAX_LEN])
 	fid.FileName = string(data[FDFS_GROUP_NAME_MAX_LEN:])
@@ -267,6 +428,25 @@ func NewFileIdFromStr(s string) (*FileId, error) {
 	return &fid, nil
 }
 
+type FileInfo struct {
+	FileSize        int64
+	CreateTimestamp time.Time
+	Crc32           uint32
+	SourceIpAddr    string
+}
+
+// #recv_fmt |-file_size(8)-create_timestamp(8)-crc32(8)-source_ip_addr(16)-|
+func (this *FileInfo) Unmarshal(data []byte) error {
+	if len(data) != STORAGE_QUERY_FILE_INFO_BODY_LEN {
+		return fmt.Errorf("%w: file info length %d is not match, expect: %d", ErrProtocol, len(data), STORAGE_QUERY_FILE_INFO_BODY_LEN)
+	}
+	this.FileSize = int64(binary.BigEndian.Uint64(data[:8]))
+	this.CreateTimestamp = time.Unix(int64(binary.BigEndian.Uint64(data[8:16])), 0)
+	this.Crc32 = uint32(binary.BigEndian.Uint64(data[16:24]))
+	this.SourceIpAddr = TrimCStr(data[24:])
+	return nil
+}
+
 type DownloadFileRequest struct {
 	Offset       int64
 	DownloadSize int64
@@ -277,8 +457,8 @@ type DownloadFileRequest struct {
 // #down_fmt: |-offset(8)-download_bytes(8)-group_name(16)-remote_filename(len)-|
 func (this *DownloadFileRequest) Marshal() ([]byte, error) {
 	buf := make([]byte, 8+8+16+len(this.FileName))
-	binary.BigEndian.PutUint64(buf[16:24], uint64(this.Offset))
-	binary.BigEndian.PutUint64(buf[24:32], uint64(this.DownloadSize))
+	binary.BigEndian.PutUint64(buf[:8], uint64(this.Offset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(this.DownloadSize))
 	// 16 bit groupName
 	copy(buf[16:32], this.GroupName)
 	// remoteFilenameLen bit remoteFilename
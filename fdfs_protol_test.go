@@ -0,0 +1,31 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDownloadFileRequestMarshal(t *testing.T) {
+	req := DownloadFileRequest{Offset: 10, DownloadSize: 20, GroupName: "group1", FileName: "M00/00/00/a.txt"}
+	buf, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// #down_fmt: |-offset(8)-download_bytes(8)-group_name(16)-remote_filename(len)-|
+	if len(buf) != 32+len(req.FileName) {
+		t.Fatalf("request has %d bytes, expect %d", len(buf), 32+len(req.FileName))
+	}
+	if offset := binary.BigEndian.Uint64(buf[:8]); offset != 10 {
+		t.Errorf("offset %d, expect 10", offset)
+	}
+	if size := binary.BigEndian.Uint64(buf[8:16]); size != 20 {
+		t.Errorf("download bytes %d, expect 20", size)
+	}
+	if group := string(bytes.TrimRight(buf[16:32], "\x00")); group != req.GroupName {
+		t.Errorf("group name %q, expect %q", group, req.GroupName)
+	}
+	if name := string(buf[32:]); name != req.FileName {
+		t.Errorf("file name %q, expect %q", name, req.FileName)
+	}
+}
@@ -0,0 +1,355 @@
+package fdfstest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cmdListOneGroup           = 90
+	cmdListAllGroups          = 91
+	cmdListStorage            = 92
+	cmdDeleteStorage          = 93
+	cmdQueryStoreWithoutGroup = 101
+	cmdQueryFetchOne          = 102
+	cmdQueryUpdate            = 103
+	cmdQueryStoreWithGroup    = 104
+	cmdQueryFetchAll          = 105
+	cmdQueryStoreWithoutAll   = 106
+	cmdQueryStoreWithGroupAll = 107
+
+	storageIdMaxSize = 16
+	domainNameLen    = 128
+	versionSize      = 6
+	groupStatSize    = groupNameLen + 1 + 11*8
+	storageStatSize  = 1 + storageIdMaxSize + ipAddressSize + domainNameLen +
+		storageIdMaxSize + versionSize + 10*8 + 42*8 + 1
+
+	statusOffline = 5
+	statusActive  = 7
+
+	// space reported for every storage
+	totalMB = 1 << 20
+)
+
+// Cluster is a tracker and its storage groups
+type Cluster struct {
+	Tracker *Server
+	// Storages of every group, in the order they are added
+	Storages []*Storage
+
+	mu     sync.Mutex
+	groups []*group
+	next   int
+}
+
+// NewCluster starts a tracker and a group of replicas storages. The storages
+// of a group listen on 127.0.0.1, 127.0.0.2... with the same port, as
+// QUERY_FETCH_ALL only returns one port for all the replicas. Where only
+// 127.0.0.1 is a loopback address, the replicas get their own port and are not
+// listed by QUERY_FETCH_ALL.
+func NewCluster(groupName string, replicas int) (*Cluster, error) {
+	c := &Cluster{}
+	tracker, err := newServer("127.0.0.1:0", c.handle)
+	if err != nil {
+		return nil, err
+	}
+	c.Tracker = tracker
+	if _, err = c.AddGroup(groupName, replicas); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// TrackerAddr returns the ip:port of the tracker
+func (c *Cluster) TrackerAddr() string {
+	return c.Tracker.Addr()
+}
+
+// AddGroup starts replicas storages in a new group
+func (c *Cluster) AddGroup(groupName string, replicas int) ([]*Storage, error) {
+	if groupName == "" || len(groupName) > groupNameLen || replicas <= 0 {
+		return nil, fmt.Errorf("invalid group %q with %d replicas", groupName, replicas)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups {
+		if g.name == groupName {
+			return nil, fmt.Errorf("group %s exists", groupName)
+		}
+	}
+
+	g := newGroup(groupName)
+	port := 0
+	for i := 0; i < replicas; i++ {
+		ipAddr := fmt.Sprintf("127.0.0.%d", i+1)
+		s := &Storage{GroupName: groupName, IpAddr: ipAddr, group: g}
+		server, err := newServer(net.JoinHostPort(ipAddr, strconv.Itoa(port)), s.handle)
+		if err != nil && i > 0 {
+			s.IpAddr = "127.0.0.1"
+			server, err = newServer("127.0.0.1:0", s.handle)
+		}
+		if err != nil {
+			for _, s := range g.storages {
+				s.Close()
+			}
+			return nil, err
+		}
+		s.Server = server
+		s.Port = server.ln.Addr().(*net.TCPAddr).Port
+		if i == 0 {
+			port = s.Port
+		}
+		g.storages = append(g.storages, s)
+	}
+	c.groups = append(c.groups, g)
+	c.Storages = append(c.Storages, g.storages...)
+	return g.storages, nil
+}
+
+// Close stops the tracker and every storage
+func (c *Cluster) Close() {
+	c.Tracker.Close()
+	for _, s := range c.Storages {
+		s.Close()
+	}
+}
+
+func (c *Cluster) group(name string) *group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// storeGroups returns the groups in the order they are tried for an upload
+// without group, it rotates between the groups
+func (c *Cluster) storeGroups() []*group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.next % len(c.groups)
+	c.next++
+	return append(append([]*group(nil), c.groups[i:]...), c.groups[:i]...)
+}
+
+func (c *Cluster) handle(cmd int8, body []byte) (int8, []byte) {
+	switch cmd {
+	case cmdQueryStoreWithoutGroup, cmdQueryStoreWithoutAll:
+		for _, g := range c.storeGroups() {
+			if storages := g.pick(); len(storages) > 0 {
+				return 0, storeBody(g, storages, cmd == cmdQueryStoreWithoutAll)
+			}
+		}
+		return ENOSPC, nil
+	case cmdQueryStoreWithGroup, cmdQueryStoreWithGroupAll:
+		if len(body) != groupNameLen {
+			return EINVAL, nil
+		}
+		g := c.group(cstr(body))
+		if g == nil {
+			return ENOENT, nil
+		}
+		storages := g.pick()
+		if len(storages) == 0 {
+			return ENOSPC, nil
+		}
+		return 0, storeBody(g, storages, cmd == cmdQueryStoreWithGroupAll)
+	case cmdQueryFetchOne, cmdQueryUpdate, cmdQueryFetchAll:
+		return c.queryFetch(cmd, body)
+	case cmdListAllGroups:
+		c.mu.Lock()
+		groups := append([]*group(nil), c.groups...)
+		c.mu.Unlock()
+		var resp []byte
+		for _, g := range groups {
+			resp = append(resp, groupStat(g)...)
+		}
+		return 0, resp
+	case cmdListOneGroup:
+		if len(body) != groupNameLen {
+			return EINVAL, nil
+		}
+		g := c.group(cstr(body))
+		if g == nil {
+			return ENOENT, nil
+		}
+		return 0, groupStat(g)
+	case cmdListStorage:
+		return c.listStorages(body)
+	case cmdDeleteStorage:
+		return c.deleteStorage(body)
+	}
+	return EINVAL, nil
+}
+
+// #query_fmt |-group_name(16)-filename(len)-|
+// #resp_fmt  |-group_name(16)-ip_addr(15)-port(8)-[ip_addr(15)]*(count-1)-|
+func (c *Cluster) queryFetch(cmd int8, body []byte) (int8, []byte) {
+	if len(body) <= groupNameLen {
+		return EINVAL, nil
+	}
+	g := c.group(cstr(body[:groupNameLen]))
+	if g == nil {
+		return ENOENT, nil
+	}
+	g.mu.Lock()
+	_, ok := g.files[string(body[groupNameLen:])]
+	g.mu.Unlock()
+	if !ok {
+		return ENOENT, nil
+	}
+
+	var storages []*Storage
+	if cmd == cmdQueryUpdate {
+		// updates go to the source storage, the first one still running
+		storages = g.active()
+	} else {
+		storages = g.pick()
+	}
+	if len(storages) == 0 {
+		return ENOENT, nil
+	}
+	first := storages[0]
+	resp := make([]byte, groupNameLen+ipAddressSize-1+8)
+	copy(resp, g.name)
+	copy(resp[groupNameLen:], first.IpAddr)
+	binary.BigEndian.PutUint64(resp[groupNameLen+ipAddressSize-1:], uint64(first.Port))
+	if cmd != cmdQueryFetchAll {
+		return 0, resp
+	}
+	for _, s := range storages[1:] {
+		if s.Port != first.Port {
+			continue
+		}
+		ip := make([]byte, ipAddressSize-1)
+		copy(ip, s.IpAddr)
+		resp = append(resp, ip...)
+	}
+	return 0, resp
+}
+
+// #list_fmt |-group_name(16)-storage_id(len)-|
+func (c *Cluster) listStorages(body []byte) (int8, []byte) {
+	if len(body) < groupNameLen {
+		return EINVAL, nil
+	}
+	g := c.group(cstr(body[:groupNameLen]))
+	if g == nil {
+		return ENOENT, nil
+	}
+	storageId := cstr(body[groupNameLen:])
+	g.mu.Lock()
+	storages := append([]*Storage(nil), g.storages...)
+	g.mu.Unlock()
+	var resp []byte
+	for _, s := range storages {
+		if storageId == "" || storageId == s.IpAddr {
+			resp = append(resp, storageStat(s)...)
+		}
+	}
+	if storageId != "" && len(resp) == 0 {
+		return ENOENT, nil
+	}
+	return 0, resp
+}
+
+// only the storages that are not running can be deleted
+func (c *Cluster) deleteStorage(body []byte) (int8, []byte) {
+	if len(body) <= groupNameLen {
+		return EINVAL, nil
+	}
+	g := c.group(cstr(body[:groupNameLen]))
+	if g == nil {
+		return ENOENT, nil
+	}
+	storageId := cstr(body[groupNameLen:])
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, s := range g.storages {
+		if s.IpAddr != storageId {
+			continue
+		}
+		if s.Running() {
+			return EBUSY, nil
+		}
+		g.storages = append(g.storages[:i:i], g.storages[i+1:]...)
+		return 0, nil
+	}
+	return ENOENT, nil
+}
+
+// #store_fmt |-group_name(16)-ip_addr(15)-port(8)-store_path_index(1)-|
+// #all_fmt   |-group_name(16)-[ip_addr(15)-port(8)]*count-store_path_index(1)-|
+func storeBody(g *group, storages []*Storage, all bool) []byte {
+	if !all {
+		storages = storages[:1]
+	}
+	const serverLen = ipAddressSize - 1 + 8
+	resp := make([]byte, groupNameLen+serverLen*len(storages)+1)
+	copy(resp, g.name)
+	for i, s := range storages {
+		off := groupNameLen + i*serverLen
+		copy(resp[off:], s.IpAddr)
+		binary.BigEndian.PutUint64(resp[off+ipAddressSize-1:], uint64(s.Port))
+	}
+	return resp
+}
+
+// #group_fmt |-group_name(17)-total_mb(8)-free_mb(8)-trunk_free_mb(8)-count(8)
+// #            -storage_port(8)-storage_http_port(8)-active_count(8)-current_write_server(8)
+// #            -store_path_count(8)-subdir_count_per_path(8)-current_trunk_file_id(8)-|
+func groupStat(g *group) []byte {
+	g.mu.Lock()
+	storages := append([]*Storage(nil), g.storages...)
+	g.mu.Unlock()
+	active, port := 0, 0
+	for _, s := range storages {
+		if s.Running() {
+			active++
+		}
+		port = s.Port
+	}
+	resp := make([]byte, groupStatSize)
+	copy(resp, g.name)
+	off := groupNameLen + 1
+	for _, v := range []int64{totalMB, totalMB, 0, int64(len(storages)), int64(port),
+		0, int64(active), 0, 1, 256, 0} {
+		binary.BigEndian.PutUint64(resp[off:], uint64(v))
+		off += 8
+	}
+	return resp
+}
+
+// #storage_fmt |-status(1)-id(16)-ip_addr(16)-domain_name(128)-src_id(16)-version(6)
+// #              -join_time(8)-up_time(8)-total_mb(8)-free_mb(8)-upload_priority(8)
+// #              -store_path_count(8)-subdir_count_per_path(8)-current_write_path(8)
+// #              -storage_port(8)-storage_http_port(8)-stat_buff(42*8)-if_trunk_server(1)-|
+func storageStat(s *Storage) []byte {
+	resp := make([]byte, storageStatSize)
+	resp[0] = statusOffline
+	if s.Running() {
+		resp[0] = statusActive
+	}
+	off := 1
+	copy(resp[off:], s.IpAddr)
+	off += storageIdMaxSize
+	copy(resp[off:], s.IpAddr)
+	off += ipAddressSize + domainNameLen + storageIdMaxSize
+	copy(resp[off:], "6.0")
+	off += versionSize
+	now := time.Now().Unix()
+	for _, v := range []int64{now, now, totalMB, totalMB, 10, 1, 256, 0, int64(s.Port), 0} {
+		binary.BigEndian.PutUint64(resp[off:], uint64(v))
+		off += 8
+	}
+	return resp
+}
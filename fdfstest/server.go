@@ -0,0 +1,235 @@
+// Package fdfstest runs an in-memory FastDFS tracker and storage servers on
+// localhost. They speak the binary protocol of FastDFS, so fdfs_client and
+// the applications built on it can be tested without a real cluster.
+package fdfstest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	headerLen = 10
+	// requests larger than this are refused by closing the connection
+	maxPkgLen = 256 << 20
+
+	cmdResp       = 100
+	cmdQuit       = 82
+	cmdActiveTest = 111
+)
+
+// error codes answered in the status of the header, FastDFS uses the errno of
+// the server
+const (
+	ENOENT = 2
+	EIO    = 5
+	EBUSY  = 16
+	EEXIST = 17
+	EINVAL = 22
+	ENOSPC = 28
+)
+
+// Fault changes how a server answers the requests of a command
+type Fault struct {
+	// Cmd is the command the fault applies to, 0 for every command
+	Cmd int8
+	// Status, if not 0, is answered instead of running the command
+	Status int8
+	// Delay is waited before answering
+	Delay time.Duration
+	// Drop closes the connection instead of answering
+	Drop bool
+	// Times is the number of requests the fault applies to, 0 means no limit
+	Times int
+}
+
+// handler runs a request and returns the status and body of the response
+type handler func(cmd int8, body []byte) (int8, []byte)
+
+// Server is a FastDFS tracker or storage listening on localhost
+type Server struct {
+	ln     net.Listener
+	handle handler
+
+	mu       sync.Mutex
+	faults   []*Fault
+	requests map[int8]int
+	conns    map[net.Conn]struct{}
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newServer(addr string, handle handler) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		handle:   handle,
+		requests: make(map[int8]int),
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the ip:port the server listens on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Inject adds a fault, faults are matched in the order they are injected
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes every injected fault
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the number of requests of cmd the server received
+func (s *Server) Requests(cmd int8) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[cmd]
+}
+
+// Running reports whether the server still accepts connections
+func (s *Server) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.ln.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// #pkg_fmt |-pkg_len(8)-cmd(1)-status(1)-body(pkg_len)-|
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	header := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pkgLen := int64(binary.BigEndian.Uint64(header))
+		cmd := int8(header[8])
+		if pkgLen < 0 || pkgLen > maxPkgLen {
+			return
+		}
+		body := make([]byte, pkgLen)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		if cmd == cmdQuit {
+			return
+		}
+
+		var (
+			status int8
+			resp   []byte
+		)
+		f := s.fault(cmd)
+		if f != nil && f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-s.done:
+				return
+			}
+		}
+		switch {
+		case f != nil && f.Drop:
+			return
+		case f != nil && f.Status != 0:
+			status = f.Status
+		case cmd == cmdActiveTest:
+		default:
+			status, resp = s.handle(cmd, body)
+		}
+		if status != 0 {
+			resp = nil
+		}
+
+		out := make([]byte, headerLen+len(resp))
+		binary.BigEndian.PutUint64(out, uint64(len(resp)))
+		out[8] = cmdResp
+		out[9] = byte(status)
+		copy(out[headerLen:], resp)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// fault counts the request and returns the first fault matching cmd
+func (s *Server) fault(cmd int8) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[cmd]++
+	for i, f := range s.faults {
+		if f.Cmd != 0 && f.Cmd != cmd {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
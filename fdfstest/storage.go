@@ -0,0 +1,515 @@
+package fdfstest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cmdUploadFile         = 11
+	cmdDeleteFile         = 12
+	cmdSetMetadata        = 13
+	cmdDownloadFile       = 14
+	cmdGetMetadata        = 15
+	cmdUploadSlaveFile    = 21
+	cmdQueryFileInfo      = 22
+	cmdUploadAppenderFile = 23
+	cmdAppendFile         = 24
+	cmdModifyFile         = 34
+	cmdTruncateFile       = 36
+	cmdRegenerateAppender = 38
+
+	groupNameLen  = 16
+	ipAddressSize = 16
+	prefixLen     = 16
+	extNameLen    = 6
+
+	recordSeparator = '\x01'
+	fieldSeparator  = '\x02'
+
+	// the file size encoded in the name of appender files
+	appenderFileSize = 1 << 58
+)
+
+type file struct {
+	data     []byte
+	meta     map[string]string
+	created  time.Time
+	sourceIp string
+	appender bool
+}
+
+// group is the set of storages sharing the same files, replicas are always
+// in sync
+type group struct {
+	name     string
+	mu       sync.Mutex
+	files    map[string]*file
+	storages []*Storage
+	next     int
+}
+
+func newGroup(name string) *group {
+	return &group{name: name, files: make(map[string]*file)}
+}
+
+// active returns the running storages of the group
+func (g *group) active() []*Storage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var storages []*Storage
+	for _, s := range g.storages {
+		if s.Running() {
+			storages = append(storages, s)
+		}
+	}
+	return storages
+}
+
+// pick returns the running storages of the group, rotated so that the
+// requests are spread over them
+func (g *group) pick() []*Storage {
+	storages := g.active()
+	if len(storages) == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	i := g.next % len(storages)
+	g.next++
+	g.mu.Unlock()
+	return append(append([]*Storage(nil), storages[i:]...), storages[:i]...)
+}
+
+// Storage is a storage server of a Cluster
+type Storage struct {
+	*Server
+	GroupName string
+	IpAddr    string
+	Port      int
+	group     *group
+}
+
+// File returns the content of a file of the storage group
+func (s *Storage) File(filename string) ([]byte, bool) {
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	f, ok := s.group.files[filename]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.data...), true
+}
+
+func (s *Storage) handle(cmd int8, body []byte) (int8, []byte) {
+	switch cmd {
+	case cmdUploadFile:
+		return s.upload(body, false)
+	case cmdUploadAppenderFile:
+		return s.upload(body, true)
+	case cmdUploadSlaveFile:
+		return s.uploadSlave(body)
+	case cmdDeleteFile:
+		return s.deleteFile(body)
+	case cmdDownloadFile:
+		return s.download(body)
+	case cmdSetMetadata:
+		return s.setMetadata(body)
+	case cmdGetMetadata:
+		return s.getMetadata(body)
+	case cmdQueryFileInfo:
+		return s.queryFileInfo(body)
+	case cmdAppendFile, cmdModifyFile, cmdTruncateFile:
+		return s.updateAppender(cmd, body)
+	case cmdRegenerateAppender:
+		return s.regenerateAppender(body)
+	}
+	return EINVAL, nil
+}
+
+// #upload_fmt |-store_path_index(1)-file_size(8)-file_ext_name(6)-file(file_size)-|
+func (s *Storage) upload(body []byte, appender bool) (int8, []byte) {
+	if len(body) < 1+8+extNameLen {
+		return EINVAL, nil
+	}
+	storePathIndex := int(body[0])
+	size := int64(binary.BigEndian.Uint64(body[1:9]))
+	ext := cstr(body[9:15])
+	data := body[15:]
+	if size != int64(len(data)) {
+		return EINVAL, nil
+	}
+
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var filename string
+	for {
+		filename = s.newFilename(storePathIndex, ext, data, appender)
+		if _, ok := g.files[filename]; !ok {
+			break
+		}
+	}
+	g.files[filename] = s.newFile(data, appender)
+	return 0, fileIdBody(g.name, filename)
+}
+
+// #slave_fmt |-master_len(8)-file_size(8)-prefix_name(16)-file_ext_name(6)
+// #           -master_name(master_filename_len)-file(file_size)-|
+func (s *Storage) uploadSlave(body []byte) (int8, []byte) {
+	if len(body) < 8+8+prefixLen+extNameLen {
+		return EINVAL, nil
+	}
+	masterLen := int64(binary.BigEndian.Uint64(body[:8]))
+	size := int64(binary.BigEndian.Uint64(body[8:16]))
+	prefix := cstr(body[16:32])
+	ext := cstr(body[32:38])
+	body = body[38:]
+	// the storage refuses an empty prefix, the slave would be named as its master
+	if prefix == "" || masterLen <= 0 || masterLen > int64(len(body)) || size != int64(len(body))-masterLen {
+		return EINVAL, nil
+	}
+	master := string(body[:masterLen])
+	data := body[masterLen:]
+
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.files[master]; !ok {
+		return ENOENT, nil
+	}
+	filename := slaveFilename(master, prefix, ext)
+	if _, ok := g.files[filename]; ok {
+		return EEXIST, nil
+	}
+	g.files[filename] = s.newFile(data, false)
+	return 0, fileIdBody(g.name, filename)
+}
+
+// #delete_fmt |-group_name(16)-filename(len)-|
+func (s *Storage) deleteFile(body []byte) (int8, []byte) {
+	filename, status := s.parseFileId(body)
+	if status != 0 {
+		return status, nil
+	}
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.files[filename]; !ok {
+		return ENOENT, nil
+	}
+	delete(g.files, filename)
+	return 0, nil
+}
+
+// #down_fmt |-offset(8)-download_bytes(8)-group_name(16)-filename(len)-|
+func (s *Storage) download(body []byte) (int8, []byte) {
+	if len(body) < 16 {
+		return EINVAL, nil
+	}
+	offset := int64(binary.BigEndian.Uint64(body[:8]))
+	size := int64(binary.BigEndian.Uint64(body[8:16]))
+	filename, status := s.parseFileId(body[16:])
+	if status != 0 {
+		return status, nil
+	}
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.files[filename]
+	if !ok {
+		return ENOENT, nil
+	}
+	fileSize := int64(len(f.data))
+	if offset < 0 || offset > fileSize || size < 0 {
+		return EINVAL, nil
+	}
+	// like the storage, a range beyond the end of the file is cut at the end
+	if size == 0 || size > fileSize-offset {
+		size = fileSize - offset
+	}
+	return 0, append([]byte(nil), f.data[offset:offset+size]...)
+}
+
+// #meta_fmt |-filename_len(8)-meta_len(8)-op_flag(1)-group_name(16)
+// #          -filename(filename_len)-meta(meta_len)-|
+func (s *Storage) setMetadata(body []byte) (int8, []byte) {
+	if len(body) < 8+8+1+groupNameLen {
+		return EINVAL, nil
+	}
+	filenameLen := int64(binary.BigEndian.Uint64(body[:8]))
+	metaLen := int64(binary.BigEndian.Uint64(body[8:16]))
+	flag := body[16]
+	groupName := cstr(body[17:33])
+	body = body[33:]
+	if filenameLen < 0 || metaLen < 0 || filenameLen+metaLen != int64(len(body)) {
+		return EINVAL, nil
+	}
+	if groupName != s.GroupName || (flag != 'O' && flag != 'M') {
+		return EINVAL, nil
+	}
+	filename := string(body[:filenameLen])
+	meta := parseMetadata(body[filenameLen:])
+
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.files[filename]
+	if !ok {
+		return ENOENT, nil
+	}
+	if flag == 'O' {
+		f.meta = meta
+		return 0, nil
+	}
+	for name, value := range meta {
+		f.meta[name] = value
+	}
+	return 0, nil
+}
+
+// #get_meta_fmt |-group_name(16)-filename(len)-|
+func (s *Storage) getMetadata(body []byte) (int8, []byte) {
+	filename, status := s.parseFileId(body)
+	if status != 0 {
+		return status, nil
+	}
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.files[filename]
+	if !ok {
+		return ENOENT, nil
+	}
+	return 0, formatMetadata(f.meta)
+}
+
+// #resp_fmt |-file_size(8)-create_timestamp(8)-crc32(8)-source_ip_addr(16)-|
+func (s *Storage) queryFileInfo(body []byte) (int8, []byte) {
+	filename, status := s.parseFileId(body)
+	if status != 0 {
+		return status, nil
+	}
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.files[filename]
+	if !ok {
+		return ENOENT, nil
+	}
+	resp := make([]byte, 8*3+ipAddressSize)
+	binary.BigEndian.PutUint64(resp[:8], uint64(len(f.data)))
+	binary.BigEndian.PutUint64(resp[8:16], uint64(f.created.Unix()))
+	binary.BigEndian.PutUint64(resp[16:24], uint64(crc32.ChecksumIEEE(f.data)))
+	copy(resp[24:], f.sourceIp)
+	return 0, resp
+}
+
+// #append_fmt   |-filename_len(8)-file_size(8)-filename(len)-file(file_size)-|
+// #modify_fmt   |-filename_len(8)-offset(8)-file_size(8)-filename(len)-file(file_size)-|
+// #truncate_fmt |-filename_len(8)-truncated_file_size(8)-filename(len)-|
+func (s *Storage) updateAppender(cmd int8, body []byte) (int8, []byte) {
+	fields := 2
+	if cmd == cmdModifyFile {
+		fields = 3
+	}
+	if len(body) < fields*8 {
+		return EINVAL, nil
+	}
+	filenameLen := int64(binary.BigEndian.Uint64(body[:8]))
+	offset := int64(0)
+	if cmd == cmdModifyFile {
+		offset = int64(binary.BigEndian.Uint64(body[8:16]))
+	}
+	size := int64(binary.BigEndian.Uint64(body[(fields-1)*8 : fields*8]))
+	body = body[fields*8:]
+	if filenameLen <= 0 || filenameLen > int64(len(body)) {
+		return EINVAL, nil
+	}
+	filename := string(body[:filenameLen])
+	data := body[filenameLen:]
+	if cmd != cmdTruncateFile && size != int64(len(data)) {
+		return EINVAL, nil
+	}
+
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.files[filename]
+	if !ok {
+		return ENOENT, nil
+	}
+	if !f.appender {
+		return EINVAL, nil
+	}
+	switch cmd {
+	case cmdAppendFile:
+		f.data = append(f.data, data...)
+	case cmdModifyFile:
+		if offset < 0 || offset > int64(len(f.data)) {
+			return EINVAL, nil
+		}
+		if end := offset + size; end > int64(len(f.data)) {
+			f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+		}
+		copy(f.data[offset:], data)
+	case cmdTruncateFile:
+		if size < 0 || size > int64(len(f.data)) {
+			return EINVAL, nil
+		}
+		f.data = f.data[:size]
+	}
+	return 0, nil
+}
+
+// #regenerate_fmt |-appender_filename(len)-|
+func (s *Storage) regenerateAppender(body []byte) (int8, []byte) {
+	filename := string(body)
+	if len(filename) < 3 {
+		return EINVAL, nil
+	}
+	storePathIndex, err := strconv.ParseUint(filename[1:3], 16, 8)
+	if err != nil {
+		return EINVAL, nil
+	}
+	ext := ""
+	if i := strings.LastIndexByte(filename, '.'); i > strings.LastIndexByte(filename, '/') {
+		ext = filename[i+1:]
+	}
+
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.files[filename]
+	if !ok {
+		return ENOENT, nil
+	}
+	if !f.appender {
+		return EINVAL, nil
+	}
+	var newFilename string
+	for {
+		newFilename = s.newFilename(int(storePathIndex), ext, f.data, false)
+		if _, ok := g.files[newFilename]; !ok {
+			break
+		}
+	}
+	f.appender = false
+	delete(g.files, filename)
+	g.files[newFilename] = f
+	return 0, fileIdBody(g.name, newFilename)
+}
+
+// parseFileId reads |-group_name(16)-filename(len)-| and checks the group
+func (s *Storage) parseFileId(body []byte) (string, int8) {
+	if len(body) <= groupNameLen {
+		return "", EINVAL
+	}
+	if cstr(body[:groupNameLen]) != s.GroupName {
+		return "", EINVAL
+	}
+	return string(body[groupNameLen:]), 0
+}
+
+func (s *Storage) newFile(data []byte, appender bool) *file {
+	return &file{
+		data:     append([]byte(nil), data...),
+		meta:     make(map[string]string),
+		created:  time.Now(),
+		sourceIp: s.IpAddr,
+		appender: appender,
+	}
+}
+
+// newFilename builds a name the way storage_gen_filename does:
+// M{path}/{dir}/{dir}/{base64(ip(4)-timestamp(4)-file_size(8)-crc32(4))}.{ext}
+func (s *Storage) newFilename(storePathIndex int, ext string, data []byte, appender bool) string {
+	buf := make([]byte, 20)
+	copy(buf[:4], net.ParseIP(s.IpAddr).To4())
+	binary.BigEndian.PutUint32(buf[4:8], uint32(time.Now().Unix()))
+	size := uint64(len(data))
+	switch {
+	case appender:
+		// the size of appender files changes, it is not in the name
+		size = appenderFileSize
+	case size>>32 == 0:
+		// small sizes are combined with random bits, and the top bit set
+		size |= uint64(rand.Int63n(0x007FFFFF)|0x80000000) << 32
+	}
+	binary.BigEndian.PutUint64(buf[8:16], size)
+	binary.BigEndian.PutUint32(buf[16:20], crc32.ChecksumIEEE(data))
+
+	filename := fmt.Sprintf("M%02X/%02X/%02X/%s", storePathIndex, rand.Intn(256), rand.Intn(256),
+		base64.RawURLEncoding.EncodeToString(buf))
+	if ext != "" {
+		filename += "." + ext
+	}
+	return filename
+}
+
+// slaveFilename puts prefix before the extension of master, the extension of
+// master is kept if ext is empty
+func slaveFilename(master string, prefix string, ext string) string {
+	base := master
+	if i := strings.LastIndexByte(master, '.'); i > strings.LastIndexByte(master, '/') {
+		base = master[:i]
+		if ext == "" {
+			ext = master[i+1:]
+		}
+	}
+	if ext == "" {
+		return base + prefix
+	}
+	return base + prefix + "." + ext
+}
+
+func fileIdBody(groupName string, filename string) []byte {
+	buf := make([]byte, groupNameLen+len(filename))
+	copy(buf, groupName)
+	copy(buf[groupNameLen:], filename)
+	return buf
+}
+
+func parseMetadata(data []byte) map[string]string {
+	meta := make(map[string]string)
+	if len(data) == 0 {
+		return meta
+	}
+	for _, record := range bytes.Split(data, []byte{recordSeparator}) {
+		fields := bytes.SplitN(record, []byte{fieldSeparator}, 2)
+		if len(fields) == 2 {
+			meta[string(fields[0])] = string(fields[1])
+		} else {
+			meta[string(fields[0])] = ""
+		}
+	}
+	return meta
+}
+
+func formatMetadata(meta map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	for name, value := range meta {
+		if buf.Len() > 0 {
+			buf.WriteByte(recordSeparator)
+		}
+		buf.WriteString(name)
+		buf.WriteByte(fieldSeparator)
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+func cstr(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
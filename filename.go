@@ -0,0 +1,166 @@
+package fdfs_client
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FDFS_FILE_TYPE_NORMAL   = 1
+	FDFS_FILE_TYPE_APPENDER = 2
+	FDFS_FILE_TYPE_SLAVE    = 4
+	// a normal file stored in a trunk file
+	FDFS_FILE_TYPE_TRUNK = 8
+
+	// marks of the file size encoded in filenames
+	FDFS_APPENDER_FILE_SIZE   = 1 << 58
+	FDFS_TRUNK_FILE_MARK_SIZE = 1 << 59
+
+	// source ids up to this value are storage ids, larger ones are ip addresses
+	FDFS_MAX_SERVER_ID = (1 << 24) - 1
+)
+
+type FileType int
+
+func (t FileType) String() string {
+	switch t {
+	case FDFS_FILE_TYPE_NORMAL:
+		return "NORMAL"
+	case FDFS_FILE_TYPE_APPENDER:
+		return "APPENDER"
+	case FDFS_FILE_TYPE_SLAVE:
+		return "SLAVE"
+	case FDFS_FILE_TYPE_TRUNK:
+		return "TRUNK"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(t))
+}
+
+// FilenameInfo holds the fields a storage encodes in the filenames it makes.
+// Slave filenames embed the fields of their master file.
+type FilenameInfo struct {
+	FileType       FileType
+	StorePathIndex int
+	// SubDir is the two directory levels, like "0A/3F"
+	SubDir string
+	// SourceIpAddr is the storage the file was uploaded to, it is empty if
+	// the storage is known by its id
+	SourceIpAddr    string
+	SourceId        string
+	CreateTimestamp time.Time
+	// FileSize is -1 for appender files, their size is not in the name
+	FileSize int64
+	Crc32    uint32
+	// PrefixName is set for slave files
+	PrefixName string
+	ExtName    string
+	// Trunk is set for files stored in a trunk file
+	Trunk *TrunkInfo
+}
+
+// TrunkInfo is where a small file is stored in a trunk file
+type TrunkInfo struct {
+	Id     uint32
+	Offset uint32
+	Size   uint32
+}
+
+// #filename_fmt |-M{store_path_index(2)}/{dir(2)}/{dir(2)}/-base64(27)-[trunk_info(16)]
+// #              -[prefix_name]-[.ext_name]-|
+// #base64_fmt   |-source_id(4)-create_timestamp(4)-file_size(8)-crc32(4)-|
+// #trunk_fmt    |-trunk_id(4)-offset(4)-size(4)-|
+func (this *FileId) Decode() (*FilenameInfo, error) {
+	name := this.FileName
+	n := len(name)
+	base64End := FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH
+	if n < base64End {
+		return nil, fmt.Errorf("%w: filename %q is too short", ErrInvalidArgument, name)
+	}
+	storePathIndex, err := strconv.ParseUint(name[1:3], 16, 8)
+	if name[0] != 'M' || err != nil || name[3] != '/' || name[6] != '/' || name[9] != '/' ||
+		!isUpperHex(name[4:6]) || !isUpperHex(name[7:9]) {
+		return nil, fmt.Errorf("%w: filename %q has an invalid path", ErrInvalidArgument, name)
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(name[FDFS_LOGIC_FILE_PATH_LEN:base64End])
+	if err != nil {
+		return nil, fmt.Errorf("%w: filename %q has an invalid base64 part", ErrInvalidArgument, name)
+	}
+
+	info := &FilenameInfo{
+		StorePathIndex:  int(storePathIndex),
+		SubDir:          name[4:9],
+		CreateTimestamp: time.Unix(int64(binary.BigEndian.Uint32(buf[4:8])), 0),
+		Crc32:           binary.BigEndian.Uint32(buf[16:20]),
+	}
+	sourceId := binary.BigEndian.Uint32(buf[:4])
+	if sourceId > 0 && sourceId <= FDFS_MAX_SERVER_ID {
+		info.SourceId = strconv.FormatUint(uint64(sourceId), 10)
+	} else {
+		info.SourceIpAddr = net.IP(buf[:4]).String()
+	}
+
+	size := binary.BigEndian.Uint64(buf[8:16])
+	trunk := size&FDFS_TRUNK_FILE_MARK_SIZE != 0 && n > FDFS_NORMAL_LOGIC_FILENAME_LENGTH
+	// the same test as IS_SLAVE_FILE
+	slave := n > FDFS_TRUNK_LOGIC_FILENAME_LENGTH ||
+		(n > FDFS_NORMAL_LOGIC_FILENAME_LENGTH && size&FDFS_TRUNK_FILE_MARK_SIZE == 0)
+	switch {
+	case size&FDFS_APPENDER_FILE_SIZE != 0:
+		info.FileType = FDFS_FILE_TYPE_APPENDER
+	case slave:
+		info.FileType = FDFS_FILE_TYPE_SLAVE
+	case trunk:
+		info.FileType = FDFS_FILE_TYPE_TRUNK
+	default:
+		info.FileType = FDFS_FILE_TYPE_NORMAL
+	}
+	switch {
+	case info.FileType == FDFS_FILE_TYPE_APPENDER:
+		info.FileSize = -1
+	case size>>63 != 0 || trunk:
+		// the high bits are random or marks, the low 32 bits is the size
+		info.FileSize = int64(size & 0xFFFFFFFF)
+	default:
+		info.FileSize = int64(size)
+	}
+
+	rest := name[base64End:]
+	if trunk {
+		if len(rest) < FDFS_TRUNK_FILE_INFO_LEN {
+			return nil, fmt.Errorf("%w: filename %q has no trunk info", ErrInvalidArgument, name)
+		}
+		tb, err := base64.RawURLEncoding.DecodeString(rest[:FDFS_TRUNK_FILE_INFO_LEN])
+		if err != nil {
+			return nil, fmt.Errorf("%w: filename %q has an invalid trunk info", ErrInvalidArgument, name)
+		}
+		info.Trunk = &TrunkInfo{
+			Id:     binary.BigEndian.Uint32(tb[:4]),
+			Offset: binary.BigEndian.Uint32(tb[4:8]),
+			Size:   binary.BigEndian.Uint32(tb[8:12]),
+		}
+		rest = rest[FDFS_TRUNK_FILE_INFO_LEN:]
+	}
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		info.ExtName = rest[i+1:]
+		rest = rest[:i]
+	}
+	if info.FileType == FDFS_FILE_TYPE_SLAVE {
+		info.PrefixName = rest
+	}
+	return info, nil
+}
+
+func isUpperHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package fdfs_client
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// makeFilename builds a filename the way a storage does
+func makeFilename(ip [4]byte, timestamp uint32, size uint64, crc uint32, trunk []byte, suffix string) string {
+	buf := make([]byte, 20)
+	copy(buf, ip[:])
+	binary.BigEndian.PutUint32(buf[4:8], timestamp)
+	binary.BigEndian.PutUint64(buf[8:16], size)
+	binary.BigEndian.PutUint32(buf[16:20], crc)
+	name := "M01/0A/FF/" + base64.RawURLEncoding.EncodeToString(buf)
+	if trunk != nil {
+		name += base64.RawURLEncoding.EncodeToString(trunk)
+	}
+	return name + suffix
+}
+
+func TestFileIdDecode(t *testing.T) {
+	ip := [4]byte{192, 168, 1, 2}
+	trunk := []byte{0, 0, 0, 3, 0, 0, 1, 0, 0, 0, 0, 100}
+	tests := []struct {
+		name     string
+		fileType FileType
+		size     int64
+		prefix   string
+		ext      string
+	}{
+		{makeFilename(ip, 1500000000, 0x80123456<<32|1234, 0xABCD, nil, ".jpg"), FDFS_FILE_TYPE_NORMAL, 1234, "", "jpg"},
+		{makeFilename(ip, 1500000000, 5<<32, 0xABCD, nil, ""), FDFS_FILE_TYPE_NORMAL, 5 << 32, "", ""},
+		{makeFilename(ip, 1500000000, FDFS_APPENDER_FILE_SIZE, 0xABCD, nil, ".log"), FDFS_FILE_TYPE_APPENDER, -1, "", "log"},
+		{makeFilename(ip, 1500000000, 0x80123456<<32|1234, 0xABCD, nil, "_150x150.jpg"), FDFS_FILE_TYPE_SLAVE, 1234, "_150x150", "jpg"},
+		{makeFilename(ip, 1500000000, 0x80123456<<32|FDFS_TRUNK_FILE_MARK_SIZE|100, 0xABCD, trunk, ".png"), FDFS_FILE_TYPE_TRUNK, 100, "", "png"},
+	}
+	for _, test := range tests {
+		info, err := (&FileId{GroupName: "group1", FileName: test.name}).Decode()
+		if err != nil {
+			t.Fatalf("Decode %s error: %s", test.name, err)
+		}
+		if info.FileType != test.fileType || info.FileSize != test.size ||
+			info.PrefixName != test.prefix || info.ExtName != test.ext {
+			t.Fatalf("Decode %s: %+v", test.name, info)
+		}
+		if info.StorePathIndex != 1 || info.SubDir != "0A/FF" || info.SourceIpAddr != "192.168.1.2" ||
+			info.CreateTimestamp.Unix() != 1500000000 || info.Crc32 != 0xABCD {
+			t.Fatalf("Decode %s: %+v", test.name, info)
+		}
+		if (info.Trunk != nil) != (test.fileType == FDFS_FILE_TYPE_TRUNK) {
+			t.Fatalf("Decode %s trunk info: %+v", test.name, info.Trunk)
+		}
+	}
+	info, _ := (&FileId{FileName: tests[4].name}).Decode()
+	if *info.Trunk != (TrunkInfo{Id: 3, Offset: 256, Size: 100}) {
+		t.Fatalf("trunk info error: %+v", info.Trunk)
+	}
+
+	// storage ids are used instead of ip addresses
+	info, _ = (&FileId{FileName: makeFilename([4]byte{0, 0, 0, 100}, 0, 1, 0, nil, "")}).Decode()
+	if info.SourceId != "100" || info.SourceIpAddr != "" {
+		t.Fatalf("source id error: %+v", info)
+	}
+
+	for _, name := range []string{"", "M00/00/00/short.jpg", "X00/00/00/" + tests[0].name[10:], "M00/0g/00/" + tests[0].name[10:]} {
+		if _, err := (&FileId{FileName: name}).Decode(); err == nil {
+			t.Fatalf("Decode %q should fail", name)
+		}
+	}
+}
+
+func TestFileIdDecodeUploaded(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+	data := []byte("1234567890")
+	remoteFileId, err := fdfsClient.UploadByBuffer(data, "txt")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	fid, _ := NewFileIdFromStr(remoteFileId)
+	info, err := fid.Decode()
+	if err != nil {
+		t.Fatal("Decode error:", err.Error())
+	}
+	fileInfo, err := fdfsClient.QueryFileInfo(remoteFileId)
+	if err != nil {
+		t.Fatal("QueryFileInfo error:", err.Error())
+	}
+	if info.FileType != FDFS_FILE_TYPE_NORMAL || info.FileSize != int64(len(data)) ||
+		info.Crc32 != crc32.ChecksumIEEE(data) || info.SourceIpAddr != fileInfo.SourceIpAddr {
+		t.Fatalf("Decode %s: %+v", remoteFileId, info)
+	}
+
+	appenderFileId, err := fdfsClient.UploadAppenderByBuffer(data, "log")
+	if err != nil {
+		t.Fatal("UploadAppenderByBuffer error:", err.Error())
+	}
+	defer fdfsClient.DeleteFile(appenderFileId)
+	fid, _ = NewFileIdFromStr(appenderFileId)
+	if info, _ = fid.Decode(); info == nil || info.FileType != FDFS_FILE_TYPE_APPENDER {
+		t.Fatalf("Decode %s: %+v", appenderFileId, info)
+	}
+}
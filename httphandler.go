@@ -0,0 +1,144 @@
+package fdfs_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// read ahead of the files served by HttpHandler, responses are read in
+// downloads of this size
+const DEFAULT_HTTP_READ_AHEAD_SIZE = 1 << 20
+
+// HttpHandler serves the files of /{group}/{filename} like the nginx module of
+// FastDFS. Range requests, HEAD and conditional requests are supported, the
+// ETag and Last-Modified of a file come from its file info.
+type HttpHandler struct {
+	Client *FdfsClient
+	// MetadataContentType is the metadata holding the Content-Type of a file,
+	// the Content-Type comes from the extension if it is empty or not set
+	MetadataContentType string
+	// AllowUpload enables POST and PUT of /, the body is uploaded and the file
+	// id is answered. The extension of the file is the "ext" query parameter.
+	AllowUpload bool
+	// AllowDelete enables DELETE of /{group}/{filename}
+	AllowDelete   bool
+	ReadAheadSize int
+}
+
+func NewHttpHandler(client *FdfsClient) *HttpHandler {
+	return &HttpHandler{Client: client, ReadAheadSize: DEFAULT_HTTP_READ_AHEAD_SIZE}
+}
+
+func (this *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fileId := strings.TrimPrefix(r.URL.Path, "/")
+	if fileId == "" {
+		if this.AllowUpload && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
+			this.upload(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		this.serveFile(w, r, fileId)
+	case http.MethodDelete:
+		if this.AllowDelete {
+			this.delete(w, r, fileId)
+			return
+		}
+		fallthrough
+	default:
+		allow := "GET, HEAD"
+		if this.AllowDelete {
+			allow += ", DELETE"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (this *HttpHandler) serveFile(w http.ResponseWriter, r *http.Request, fileId string) {
+	file, err := this.Client.OpenContext(r.Context(), fileId)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer file.Close()
+	if this.ReadAheadSize > 0 {
+		file.ReadAheadSize = this.ReadAheadSize
+	}
+
+	info := file.Info()
+	header := w.Header()
+	header.Set("ETag", fmt.Sprintf(`"%08x-%x"`, info.Crc32, info.FileSize))
+	header.Set("Accept-Ranges", "bytes")
+	if this.MetadataContentType != "" {
+		metadata, err := this.Client.GetMetadataContext(r.Context(), fileId)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if contentType := metadata[this.MetadataContentType]; contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+	// the Content-Type is found by the extension of the name, or sniffed
+	http.ServeContent(w, r, fileId, info.CreateTimestamp, file)
+}
+
+func (this *HttpHandler) upload(w http.ResponseWriter, r *http.Request) {
+	ext := r.URL.Query().Get("ext")
+	var (
+		fileId string
+		err    error
+	)
+	if r.ContentLength >= 0 {
+		fileId, err = this.Client.UploadByReaderContext(r.Context(), r.Body, r.ContentLength, ext)
+	} else {
+		// chunked request body
+		uw := this.Client.NewUploadWriterContext(r.Context(), ext)
+		if _, err = io.Copy(uw, r.Body); err == nil {
+			err = uw.Close()
+		} else {
+			uw.Close()
+		}
+		fileId = uw.FileId()
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/"+fileId)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, fileId)
+}
+
+func (this *HttpHandler) delete(w http.ResponseWriter, r *http.Request, fileId string) {
+	if err := this.Client.DeleteFileContext(r.Context(), fileId); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalidArgument):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrNoSpace):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	// the error is not answered, it tells the addresses of the servers
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,109 @@
+package fdfs_client
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpHandler(t *testing.T) {
+	fdfsClient := &FdfsClient{ConnPool: connPool}
+	handler := NewHttpHandler(fdfsClient)
+	handler.AllowUpload = true
+	handler.AllowDelete = true
+	handler.ReadAheadSize = 4
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	do := func(method, path string, body string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(method, path, "error:", err)
+		}
+		buf, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(buf)
+	}
+
+	resp, fileId := do("POST", "/?ext=txt", "0123456789abcdef")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/"+fileId {
+		t.Fatalf("POST answers %d %q", resp.StatusCode, fileId)
+	}
+	path := "/" + fileId
+
+	resp, body := do("GET", path, "")
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || body != "0123456789abcdef" || etag == "" || lastModified == "" ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("GET answers %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp, body = do("HEAD", path, ""); resp.StatusCode != http.StatusOK || body != "" || resp.ContentLength != 16 {
+		t.Fatalf("HEAD answers %d, length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if resp, body = do("GET", path, "", "Range", "bytes=3-9"); resp.StatusCode != http.StatusPartialContent ||
+		body != "3456789" {
+		t.Fatalf("range GET answers %d %q", resp.StatusCode, body)
+	}
+
+	resp, body = do("GET", path, "", "Range", "bytes=0-1,-3")
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		buf, _ := io.ReadAll(part)
+		parts = append(parts, string(buf))
+	}
+	if resp.StatusCode != http.StatusPartialContent || strings.Join(parts, ",") != "01,def" {
+		t.Fatalf("multi-range GET answers %d %q", resp.StatusCode, parts)
+	}
+
+	if resp, _ = do("GET", path, "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("GET If-None-Match answers %d", resp.StatusCode)
+	}
+	if resp, _ = do("GET", path, "", "If-Modified-Since", lastModified); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("GET If-Modified-Since answers %d", resp.StatusCode)
+	}
+
+	handler.MetadataContentType = "mime"
+	fdfsClient.SetMetadata(fileId, map[string]string{"mime": "application/x-test"}, STORAGE_SET_METADATA_FLAG_OVERWRITE)
+	if resp, _ = do("GET", path, ""); resp.Header.Get("Content-Type") != "application/x-test" {
+		t.Fatalf("Content-Type is %q, expect the one of metadata", resp.Header.Get("Content-Type"))
+	}
+
+	if resp, _ = do("PATCH", path, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("PATCH answers %d", resp.StatusCode)
+	}
+	if resp, _ = do("DELETE", path, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE answers %d", resp.StatusCode)
+	}
+	if resp, _ = do("GET", path, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of a deleted file answers %d", resp.StatusCode)
+	}
+	// chunked request body
+	resp, err := http.Post(server.URL+"/?ext=txt", "text/plain", io.MultiReader(strings.NewReader("chunked")))
+	if err != nil {
+		t.Fatal("chunked POST error:", err)
+	}
+	buf, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if _, body = do("GET", "/"+string(buf), ""); body != "chunked" {
+		t.Fatalf("chunked POST uploads %q", body)
+	}
+	do("DELETE", "/"+string(buf), "")
+
+	if resp, _ = do("GET", "/group1", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET of an invalid file id answers %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,125 @@
+package fdfs_client
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Instrumentation is told about every request sent to trackers and storages,
+// and about the connections of the pools. Its methods are called
+// concurrently and must not block.
+type Instrumentation interface {
+	// RpcStart is called once the connection of a request is ready, the
+	// returned context is passed to RpcFinish so that a trace span can be
+	// kept in it
+	RpcStart(ctx context.Context, cmd int8, addr string) context.Context
+	RpcFinish(ctx context.Context, rpc *RpcInfo)
+	PoolEvent(event *PoolEvent)
+}
+
+// RpcInfo is a finished request
+type RpcInfo struct {
+	Cmd  int8
+	Addr string
+	// BytesSent and BytesRecv include the headers
+	BytesSent int64
+	BytesRecv int64
+	Duration  time.Duration
+	Err       error
+}
+
+type PoolEventType int
+
+const (
+	// a connection is dialed, Duration is the time of the dial
+	POOL_EVENT_DIAL PoolEventType = iota
+	// an idle connection is reused
+	POOL_EVENT_REUSE
+	// an idle connection fails FDFS_PROTO_CMD_ACTIVE_TEST and is closed
+	POOL_EVENT_ACTIVE_TEST_FAILED
+	// a connection is closed instead of being put back into the pool, after
+	// an error or when the pool is full
+	POOL_EVENT_DISCARD
+	// a Get waits as the pool has MaxConns connections
+	POOL_EVENT_EXHAUSTED
+)
+
+func (t PoolEventType) String() string {
+	switch t {
+	case POOL_EVENT_DIAL:
+		return "dial"
+	case POOL_EVENT_REUSE:
+		return "reuse"
+	case POOL_EVENT_ACTIVE_TEST_FAILED:
+		return "active_test_failed"
+	case POOL_EVENT_DISCARD:
+		return "discard"
+	case POOL_EVENT_EXHAUSTED:
+		return "exhausted"
+	}
+	return "unknown"
+}
+
+type PoolEvent struct {
+	Type PoolEventType
+	// Addr is the ip:port of the server
+	Addr     string
+	Duration time.Duration
+	Err      error
+}
+
+// MultiInstrumentation reports to every inst in turn
+func MultiInstrumentation(insts ...Instrumentation) Instrumentation {
+	return multiInstrumentation(insts)
+}
+
+type multiInstrumentation []Instrumentation
+
+func (m multiInstrumentation) RpcStart(ctx context.Context, cmd int8, addr string) context.Context {
+	for _, inst := range m {
+		ctx = inst.RpcStart(ctx, cmd, addr)
+	}
+	return ctx
+}
+
+func (m multiInstrumentation) RpcFinish(ctx context.Context, rpc *RpcInfo) {
+	for _, inst := range m {
+		inst.RpcFinish(ctx, rpc)
+	}
+}
+
+func (m multiInstrumentation) PoolEvent(event *PoolEvent) {
+	for _, inst := range m {
+		inst.PoolEvent(event)
+	}
+}
+
+// startRpc tells inst that a request starts on conn, the returned function
+// must be called with the result of the request
+func startRpc(ctx context.Context, inst Instrumentation, cmd int8, conn net.Conn) func(err error) {
+	if inst == nil {
+		return func(error) {}
+	}
+	pc, _ := conn.(*PoolConn)
+	var sent, recv int64
+	if pc != nil {
+		sent, recv = pc.sent, pc.recv
+	}
+	addr := conn.RemoteAddr().String()
+	start := time.Now()
+	ctx = inst.RpcStart(ctx, cmd, addr)
+	return func(err error) {
+		rpc := &RpcInfo{Cmd: cmd, Addr: addr, Duration: time.Since(start), Err: err}
+		if pc != nil {
+			rpc.BytesSent, rpc.BytesRecv = pc.sent-sent, pc.recv-recv
+		}
+		inst.RpcFinish(ctx, rpc)
+	}
+}
+
+func poolEvent(inst Instrumentation, typ PoolEventType, addr string, d time.Duration, err error) {
+	if inst != nil {
+		inst.PoolEvent(&PoolEvent{Type: typ, Addr: addr, Duration: d, Err: err})
+	}
+}
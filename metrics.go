@@ -0,0 +1,213 @@
+package fdfs_client
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// upper bounds of the buckets of the request durations, in seconds
+var metricsDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// Metrics is an Instrumentation that counts the requests by command and
+// server, and the pool events. It is exported in the Prometheus text format
+// by WritePrometheus and ServeHTTP, and with expvar by Publish.
+type Metrics struct {
+	mu       sync.Mutex
+	rpcs     map[metricsKey]*rpcMetrics
+	events   map[metricsKey]int64
+	inFlight map[string]int64
+}
+
+// metricsKey is a command or a pool event, and a server address
+type metricsKey struct {
+	name string
+	addr string
+}
+
+type rpcMetrics struct {
+	count     int64
+	errors    int64
+	bytesSent int64
+	bytesRecv int64
+	seconds   float64
+	// buckets[i] counts the durations up to metricsDurationBuckets[i]
+	buckets []int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		rpcs:     make(map[metricsKey]*rpcMetrics),
+		events:   make(map[metricsKey]int64),
+		inFlight: make(map[string]int64),
+	}
+}
+
+func (this *Metrics) RpcStart(ctx context.Context, cmd int8, addr string) context.Context {
+	this.mu.Lock()
+	this.inFlight[cmdName(cmd)]++
+	this.mu.Unlock()
+	return ctx
+}
+
+func (this *Metrics) RpcFinish(ctx context.Context, rpc *RpcInfo) {
+	name := cmdName(rpc.Cmd)
+	seconds := rpc.Duration.Seconds()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.inFlight[name]--
+	key := metricsKey{name, rpc.Addr}
+	m := this.rpcs[key]
+	if m == nil {
+		m = &rpcMetrics{buckets: make([]int64, len(metricsDurationBuckets))}
+		this.rpcs[key] = m
+	}
+	m.count++
+	if rpc.Err != nil {
+		m.errors++
+	}
+	m.bytesSent += rpc.BytesSent
+	m.bytesRecv += rpc.BytesRecv
+	m.seconds += seconds
+	for i, le := range metricsDurationBuckets {
+		if seconds <= le {
+			m.buckets[i]++
+		}
+	}
+}
+
+func (this *Metrics) PoolEvent(event *PoolEvent) {
+	this.mu.Lock()
+	this.events[metricsKey{event.Type.String(), event.Addr}]++
+	this.mu.Unlock()
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (this *Metrics) WritePrometheus(w io.Writer) error {
+	this.mu.Lock()
+	rpcKeys := make([]metricsKey, 0, len(this.rpcs))
+	for key := range this.rpcs {
+		rpcKeys = append(rpcKeys, key)
+	}
+	sortMetricsKeys(rpcKeys)
+	b := &strings.Builder{}
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(m *rpcMetrics) int64
+	}{
+		{"fdfs_rpc_requests_total", "Requests sent to trackers and storages.", func(m *rpcMetrics) int64 { return m.count }},
+		{"fdfs_rpc_errors_total", "Requests that failed.", func(m *rpcMetrics) int64 { return m.errors }},
+		{"fdfs_rpc_sent_bytes_total", "Bytes sent by the requests.", func(m *rpcMetrics) int64 { return m.bytesSent }},
+		{"fdfs_rpc_received_bytes_total", "Bytes received by the requests.", func(m *rpcMetrics) int64 { return m.bytesRecv }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, key := range rpcKeys {
+			fmt.Fprintf(b, "%s{cmd=%s,addr=%s} %d\n", c.name, promLabel(key.name), promLabel(key.addr), c.value(this.rpcs[key]))
+		}
+	}
+
+	b.WriteString("# HELP fdfs_rpc_duration_seconds Duration of the requests.\n# TYPE fdfs_rpc_duration_seconds histogram\n")
+	for _, key := range rpcKeys {
+		m := this.rpcs[key]
+		labels := "cmd=" + promLabel(key.name) + ",addr=" + promLabel(key.addr)
+		for i, le := range metricsDurationBuckets {
+			fmt.Fprintf(b, "fdfs_rpc_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels,
+				strconv.FormatFloat(le, 'g', -1, 64), m.buckets[i])
+		}
+		fmt.Fprintf(b, "fdfs_rpc_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, m.count)
+		fmt.Fprintf(b, "fdfs_rpc_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(m.seconds, 'g', -1, 64))
+		fmt.Fprintf(b, "fdfs_rpc_duration_seconds_count{%s} %d\n", labels, m.count)
+	}
+
+	names := make([]string, 0, len(this.inFlight))
+	for name := range this.inFlight {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("# HELP fdfs_rpc_in_flight Requests in progress.\n# TYPE fdfs_rpc_in_flight gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(b, "fdfs_rpc_in_flight{cmd=%s} %d\n", promLabel(name), this.inFlight[name])
+	}
+
+	eventKeys := make([]metricsKey, 0, len(this.events))
+	for key := range this.events {
+		eventKeys = append(eventKeys, key)
+	}
+	sortMetricsKeys(eventKeys)
+	b.WriteString("# HELP fdfs_pool_events_total Events of the connection pools.\n# TYPE fdfs_pool_events_total counter\n")
+	for _, key := range eventKeys {
+		fmt.Fprintf(b, "fdfs_pool_events_total{event=%s,addr=%s} %d\n", promLabel(key.name), promLabel(key.addr), this.events[key])
+	}
+	this.mu.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP answers the metrics in the Prometheus text format
+func (this *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	this.WritePrometheus(w)
+}
+
+// Publish exports the metrics as the expvar name, its value is like
+// {"rpc": {cmd: {addr: {"requests": n, ...}}}, "pool": {event: {addr: n}}}.
+// It returns an ErrExists error if the name is already published.
+func (this *Metrics) Publish(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("%w: expvar %s is already published", ErrExists, name)
+	}
+	expvar.Publish(name, expvar.Func(this.expvarValue))
+	return nil
+}
+
+func (this *Metrics) expvarValue() interface{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	rpcs := make(map[string]map[string]map[string]interface{})
+	for key, m := range this.rpcs {
+		if rpcs[key.name] == nil {
+			rpcs[key.name] = make(map[string]map[string]interface{})
+		}
+		rpcs[key.name][key.addr] = map[string]interface{}{
+			"requests":         m.count,
+			"errors":           m.errors,
+			"sent_bytes":       m.bytesSent,
+			"received_bytes":   m.bytesRecv,
+			"duration_seconds": m.seconds,
+			"in_flight":        this.inFlight[key.name],
+		}
+	}
+	events := make(map[string]map[string]int64)
+	for key, n := range this.events {
+		if events[key.name] == nil {
+			events[key.name] = make(map[string]int64)
+		}
+		events[key.name][key.addr] = n
+	}
+	return map[string]interface{}{"rpc": rpcs, "pool": events}
+}
+
+func sortMetricsKeys(keys []metricsKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].addr < keys[j].addr
+	})
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(v string) string {
+	return `"` + promLabelEscaper.Replace(v) + `"`
+}
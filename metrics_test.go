@@ -0,0 +1,158 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+func TestMetrics(t *testing.T) {
+	host, port, _ := splitHostPort(cluster.TrackerAddr())
+	pool, err := NewConnectionPool([]string{host}, port, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagePool, err := NewStoragePool(2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdfsClient := &FdfsClient{ConnPool: pool, StoragePool: storagePool}
+	defer fdfsClient.Close()
+	metrics := NewMetrics()
+	fdfsClient.SetInstrumentation(metrics)
+
+	data := []byte("hello metrics")
+	fileId, err := fdfsClient.UploadByBuffer(data, "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fdfsClient.DownloadEx(fileId, &bytes.Buffer{}, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	storageAddr := metrics.rpcAddr("download")
+	if storageAddr == "" {
+		t.Fatal("no download is counted")
+	}
+
+	// the upload is dropped by every storage, its connection is discarded
+	for _, s := range cluster.Storages {
+		s.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_UPLOAD_FILE, Drop: true, Times: 1})
+		defer s.ClearFaults()
+	}
+	if _, err = fdfsClient.UploadByBuffer(data, "txt"); err == nil {
+		t.Fatal("UploadByBuffer succeeds with a dropped upload")
+	}
+
+	b := &strings.Builder{}
+	if err = metrics.WritePrometheus(b); err != nil {
+		t.Fatal(err)
+	}
+	text := b.String()
+	expects := []string{
+		fmt.Sprintf(`fdfs_rpc_requests_total{cmd="download",addr=%q} 1`, storageAddr),
+		fmt.Sprintf(`fdfs_rpc_errors_total{cmd="download",addr=%q} 0`, storageAddr),
+		fmt.Sprintf(`fdfs_rpc_received_bytes_total{cmd="download",addr=%q} %d`, storageAddr, FDFS_PROTO_PKG_LEN_SIZE+2+len(data)),
+		fmt.Sprintf(`fdfs_rpc_duration_seconds_count{cmd="download",addr=%q} 1`, storageAddr),
+		fmt.Sprintf(`fdfs_rpc_duration_seconds_bucket{cmd="download",addr=%q,le="+Inf"} 1`, storageAddr),
+		fmt.Sprintf(`fdfs_rpc_requests_total{cmd="query_fetch",addr=%q} 1`, cluster.TrackerAddr()),
+		`fdfs_rpc_in_flight{cmd="upload"} 0`,
+		fmt.Sprintf(`fdfs_pool_events_total{event="reuse",addr=%q}`, cluster.TrackerAddr()),
+		`fdfs_pool_events_total{event="dial"`,
+		`fdfs_pool_events_total{event="discard"`,
+		"# TYPE fdfs_rpc_duration_seconds histogram",
+	}
+	for _, expect := range expects {
+		if !strings.Contains(text, expect) {
+			t.Errorf("metrics has no %s:\n%s", expect, text)
+		}
+	}
+	if !strings.Contains(text, `fdfs_rpc_errors_total{cmd="upload"`) ||
+		strings.Contains(text, `fdfs_rpc_errors_total{cmd="upload",addr=""} 0`) {
+		t.Errorf("the dropped upload is not counted:\n%s", text)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", ct)
+	}
+
+	// the name is already published by a previous run with -count
+	if err = metrics.Publish("fdfs_test_metrics"); err != nil && !errors.Is(err, ErrExists) {
+		t.Fatal("Publish error:", err)
+	}
+	if err = metrics.Publish("fdfs_test_metrics"); !errors.Is(err, ErrExists) {
+		t.Fatalf("second Publish returns %v, expect ErrExists", err)
+	}
+	var value struct {
+		Rpc  map[string]map[string]map[string]float64
+		Pool map[string]map[string]int64
+	}
+	if err = json.Unmarshal([]byte(expvar.Func(metrics.expvarValue).String()), &value); err != nil {
+		t.Fatal(err)
+	}
+	if n := value.Rpc["download"][storageAddr]["requests"]; n != 1 {
+		t.Errorf("expvar has %v downloads, expect 1", n)
+	}
+	if value.Pool["reuse"][cluster.TrackerAddr()] == 0 {
+		t.Errorf("expvar has no tracker reuse: %v", value.Pool)
+	}
+}
+
+func TestSetInstrumentationInUse(t *testing.T) {
+	storagePool, err := NewStoragePool(2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdfsClient := &FdfsClient{ConnPool: connPool, StoragePool: storagePool}
+	defer storagePool.Close()
+	fileId, err := fdfsClient.UploadByBuffer([]byte("hello metrics"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fdfsClient.DeleteFile(fileId)
+
+	// the pools are told of the change while they are used, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			fdfsClient.DownloadEx(fileId, io.Discard, 0, 0)
+		}
+	}()
+	metrics := NewMetrics()
+	for {
+		select {
+		case <-done:
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			if len(metrics.events) == 0 {
+				t.Error("the storage pools report no event")
+			}
+			return
+		case <-time.After(100 * time.Microsecond):
+			storagePool.SetInstrumentation(metrics)
+		}
+	}
+}
+
+// rpcAddr returns an address that requests of the command name are sent to
+func (this *Metrics) rpcAddr(name string) string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for key := range this.rpcs {
+		if key.name == name {
+			return key.addr
+		}
+	}
+	return ""
+}
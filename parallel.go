@@ -0,0 +1,111 @@
+package fdfs_client
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// tries of every range of a parallel download, at least one per replica
+const DOWNLOAD_RANGE_MAX_TRIES = 3
+
+func (this *FdfsClient) DownloadParallel(remoteFileId string, output io.WriterAt, ranges int) (size int64, e error) {
+	return this.DownloadParallelContext(context.Background(), remoteFileId, output, ranges)
+}
+
+// DownloadParallelContext splits a file into ranges that are downloaded
+// concurrently, over one connection each, and written to output at their
+// offset. The ranges are spread over the replicas of the file, a failed range
+// is retried on the next replica from where it stopped.
+func (this *FdfsClient) DownloadParallelContext(ctx context.Context, remoteFileId string, output io.WriterAt, ranges int) (size int64, e error) {
+	fid, err := NewFileIdFromStr(remoteFileId)
+	if err != nil {
+		return 0, err
+	}
+	tc := this.trackerClient()
+	stores, err := tc.QueryStorageFetchAllContext(ctx, fid)
+	if err != nil {
+		return 0, err
+	}
+	var info *FileInfo
+	for _, store := range stores {
+		if info, err = store.QueryFileInfoContext(ctx, fid.FileName); err == nil || !IsRetryable(err) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	size = info.FileSize
+	if size == 0 {
+		return 0, nil
+	}
+	if ranges <= 0 {
+		ranges = 1
+	}
+	if int64(ranges) > size {
+		ranges = int(size)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	rangeSize := (size + int64(ranges) - 1) / int64(ranges)
+	for i := 0; i < ranges; i++ {
+		offset := int64(i) * rangeSize
+		length := rangeSize
+		if offset+length > size {
+			length = size - offset
+		}
+		if length <= 0 {
+			break
+		}
+		wg.Add(1)
+		go func(i int, offset, length int64) {
+			defer wg.Done()
+			if err := downloadRange(ctx, stores, i, fid.FileName, output, offset, length); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, offset, length)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return size, nil
+}
+
+// downloadRange starts on the replica first, and moves to the next replica
+// after a retryable error
+func downloadRange(ctx context.Context, stores []*StorageClient, first int, remoteFilename string,
+	output io.WriterAt, offset int64, length int64) error {
+	tries := DOWNLOAD_RANGE_MAX_TRIES
+	if tries < len(stores) {
+		tries = len(stores)
+	}
+	var err error
+	for i := 0; i < tries; i++ {
+		store := stores[(first+i)%len(stores)]
+		var n int64
+		n, err = store.DownloadExContext(ctx, remoteFilename, io.NewOffsetWriter(output, offset), offset, length)
+		offset += n
+		length -= n
+		if err == nil || length == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+func TestDownloadParallel(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+	data := make([]byte, 100*1024+3)
+	rand.Read(data)
+	remoteFileId, err := fdfsClient.UploadByBuffer(data, "bin")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err)
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	// a few ranges fail on the first replica and are retried
+	cluster.Storages[0].Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_DOWNLOAD_FILE, Drop: true, Times: 2})
+	defer cluster.Storages[0].ClearFaults()
+
+	for _, ranges := range []int{1, 7, 16} {
+		file, err := os.Create(filepath.Join(t.TempDir(), "download.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := fdfsClient.DownloadParallel(remoteFileId, file, ranges)
+		file.Close()
+		if err != nil {
+			t.Fatalf("DownloadParallel with %d ranges error: %v", ranges, err)
+		}
+		buf, _ := os.ReadFile(file.Name())
+		if size != int64(len(data)) || !bytes.Equal(buf, data) {
+			t.Fatalf("DownloadParallel with %d ranges downloads %d bytes, content is different", ranges, size)
+		}
+	}
+
+	fdfsClient.DeleteFile(remoteFileId)
+	file, _ := os.Create(filepath.Join(t.TempDir(), "deleted.bin"))
+	defer file.Close()
+	if _, err = fdfsClient.DownloadParallel(remoteFileId, file, 4); err == nil {
+		t.Fatal("DownloadParallel of a deleted file succeeds")
+	}
+}
@@ -0,0 +1,90 @@
+package fdfs_client
+
+import (
+	"sort"
+	"time"
+)
+
+// PoolStats is a snapshot of a ConnectionPool or of a StoragePool
+type PoolStats struct {
+	Idle  int
+	InUse int
+	// WaitCount is the number of waits of Get for a free connection, and
+	// WaitDuration their total time
+	WaitCount    int64
+	WaitDuration time.Duration
+	Servers      []ServerStats
+}
+
+// ServerStats is a snapshot of the connections to a server
+type ServerStats struct {
+	// Addr is the host:port of the server
+	Addr string
+	Idle int
+	// InUse counts the connections taken by Get and the idle ones under an
+	// active test, so that Idle + InUse is the number of open connections
+	InUse int
+	// Dials counts the dials of the server, DialFailures the failed ones
+	Dials        int64
+	DialFailures int64
+	// ActiveTestFailures counts the idle connections that failed
+	// FDFS_PROTO_CMD_ACTIVE_TEST
+	ActiveTestFailures int64
+	// ErrorCloses counts the connections closed after an error of a request
+	ErrorCloses int64
+	// Quarantined tells whether the server is skipped after failed dials
+	Quarantined bool
+}
+
+// Stats returns the counters of the pool and of every server
+func (this *ConnectionPool) Stats() PoolStats {
+	now := time.Now()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	stats := PoolStats{
+		WaitCount:    this.waitCount,
+		WaitDuration: this.waitDuration,
+		Servers:      make([]ServerStats, 0, len(this.endpoints)),
+	}
+	for _, ep := range this.endpoints {
+		s := ServerStats{
+			Addr:               ep.addr,
+			Idle:               ep.open - ep.inUse,
+			InUse:              ep.inUse,
+			Dials:              ep.dials,
+			DialFailures:       ep.dialFailures,
+			ActiveTestFailures: ep.activeTestFailures,
+			ErrorCloses:        ep.errorCloses,
+			Quarantined:        now.Before(ep.downUntil),
+		}
+		stats.Idle += s.Idle
+		stats.InUse += s.InUse
+		stats.Servers = append(stats.Servers, s)
+	}
+	return stats
+}
+
+// Stats returns the sum of the counters of the pools of every storage, with
+// the counters of each storage in Servers
+func (this *StoragePool) Stats() PoolStats {
+	this.mu.Lock()
+	pools := make([]*ConnectionPool, 0, len(this.pools))
+	for _, pool := range this.pools {
+		pools = append(pools, pool)
+	}
+	this.mu.Unlock()
+
+	var stats PoolStats
+	for _, pool := range pools {
+		s := pool.Stats()
+		stats.Idle += s.Idle
+		stats.InUse += s.InUse
+		stats.WaitCount += s.WaitCount
+		stats.WaitDuration += s.WaitDuration
+		stats.Servers = append(stats.Servers, s.Servers...)
+	}
+	sort.Slice(stats.Servers, func(i, j int) bool {
+		return stats.Servers[i].Addr < stats.Servers[j].Addr
+	})
+	return stats
+}
@@ -0,0 +1,134 @@
+package fdfs_client
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+func TestConnectionPoolStats(t *testing.T) {
+	dead := deadAddr(t)
+	pool, err := NewConnectionPoolWithAddrs([]string{dead, cluster.TrackerAddr()}, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.Selector = firstSelector{}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err = pool.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("GetContext returns %v, expect context.DeadlineExceeded", err)
+	}
+	stats := pool.Stats()
+	if stats.InUse != 1 || stats.Idle != 0 || stats.WaitCount != 1 || stats.WaitDuration < 30*time.Millisecond {
+		t.Fatalf("stats error: %+v", stats)
+	}
+	if s := stats.Servers[0]; s.Addr != dead || s.Dials != 1 || s.DialFailures != 1 || !s.Quarantined {
+		t.Fatalf("dead tracker stats error: %+v", s)
+	}
+	if s := stats.Servers[1]; s.Dials != 1 || s.DialFailures != 0 || s.InUse != 1 || s.Quarantined {
+		t.Fatalf("tracker stats error: %+v", s)
+	}
+
+	// a connection closed after an error
+	discardConn(conn, io.ErrUnexpectedEOF)
+	conn.Close()
+	if s := pool.Stats().Servers[1]; s.ErrorCloses != 1 || s.InUse != 0 || s.Idle != 0 {
+		t.Fatalf("stats after an error close: %+v", s)
+	}
+
+	// an idle connection that fails the active test
+	conn, _ = pool.Get()
+	conn.Close()
+	if s := pool.Stats().Servers[1]; s.Idle != 1 || s.InUse != 0 {
+		t.Fatalf("stats with an idle connection: %+v", s)
+	}
+	cluster.Tracker.Inject(fdfstest.Fault{Cmd: FDFS_PROTO_CMD_ACTIVE_TEST, Drop: true, Times: 1})
+	defer cluster.Tracker.ClearFaults()
+	conn, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if s := pool.Stats().Servers[1]; s.ActiveTestFailures != 1 || s.Dials != 3 || s.Idle != 1 {
+		t.Fatalf("stats after a failed active test: %+v", s)
+	}
+}
+
+func TestStoragePoolStats(t *testing.T) {
+	storagePool, err := NewStoragePool(2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdfsClient := &FdfsClient{ConnPool: connPool, StoragePool: storagePool}
+	defer storagePool.Close()
+
+	fileId, err := fdfsClient.UploadByBuffer([]byte("stats"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fdfsClient.DeleteFile(fileId); err != nil {
+		t.Fatal(err)
+	}
+	stats := storagePool.Stats()
+	if stats.Idle == 0 || stats.InUse != 0 || len(stats.Servers) == 0 {
+		t.Fatalf("stats error: %+v", stats)
+	}
+	var dials int64
+	for _, s := range stats.Servers {
+		dials += s.Dials
+	}
+	if dials == 0 || dials > 2 {
+		t.Fatalf("%d storage dials, expect 1 or 2", dials)
+	}
+}
+
+func TestConnectionPoolStatsHealthCheck(t *testing.T) {
+	pool, err := NewConnectionPoolWithAddrs([]string{cluster.TrackerAddr()}, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.HealthCheckInterval = 100 * time.Millisecond
+	pool.TestOnGet = false
+
+	tracker := cluster.Tracker
+	tracker.Inject(fdfstest.Fault{Cmd: FDFS_PROTO_CMD_ACTIVE_TEST, Delay: 60 * time.Millisecond, Times: 1})
+	defer tracker.ClearFaults()
+	pings := tracker.Requests(FDFS_PROTO_CMD_ACTIVE_TEST)
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// the idle connection under the active test is in use by the check
+	deadline := time.Now().Add(time.Second)
+	for tracker.Requests(FDFS_PROTO_CMD_ACTIVE_TEST) == pings {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle connection is not pinged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := pool.Stats().Servers[0]; s.Idle != 0 || s.InUse != 1 {
+		t.Fatalf("stats under an active test: %+v", s)
+	}
+
+	for pool.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the pinged connection is not put back")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := pool.Stats().Servers[0]; s.Idle != 1 || s.InUse != 0 {
+		t.Fatalf("stats after an active test: %+v", s)
+	}
+}
@@ -0,0 +1,203 @@
+package fdfs_client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const DEFAULT_READ_AHEAD_SIZE = 64 << 10
+
+// RemoteFile reads a remote file with ranged downloads. Sequential reads are
+// served from a read ahead buffer, ReadAt is safe for concurrent use.
+type RemoteFile struct {
+	client *FdfsClient
+	fileId string
+	ctx    context.Context
+	info   *FileInfo
+	// ReadAheadSize is the min size of the downloads of Read, reads larger
+	// than it are not buffered
+	ReadAheadSize int
+
+	mu        sync.Mutex
+	offset    int64
+	buf       []byte
+	bufOffset int64
+	closed    bool
+}
+
+func (this *FdfsClient) Open(remoteFileId string) (*RemoteFile, error) {
+	return this.OpenContext(context.Background(), remoteFileId)
+}
+
+// OpenContext queries the size of a remote file, the downloads of the
+// returned RemoteFile use ctx.
+func (this *FdfsClient) OpenContext(ctx context.Context, remoteFileId string) (*RemoteFile, error) {
+	info, err := this.QueryFileInfoContext(ctx, remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteFile{
+		client:        this,
+		fileId:        remoteFileId,
+		ctx:           ctx,
+		info:          info,
+		ReadAheadSize: DEFAULT_READ_AHEAD_SIZE,
+	}, nil
+}
+
+// Name returns the file id
+func (this *RemoteFile) Name() string {
+	return this.fileId
+}
+
+// Size is the size of the file when it is opened
+func (this *RemoteFile) Size() int64 {
+	return this.info.FileSize
+}
+
+func (this *RemoteFile) Info() *FileInfo {
+	return this.info
+}
+
+func (this *RemoteFile) Read(p []byte) (n int, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return 0, os.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if this.offset >= this.info.FileSize {
+		return 0, io.EOF
+	}
+
+	if !this.buffered(this.offset) {
+		this.buf = this.buf[:0]
+		if len(p) >= this.ReadAheadSize {
+			// large reads go straight to p
+			n, err = this.readAt(p, this.offset)
+			this.offset += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		if err = this.fill(this.offset); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, this.buf[this.offset-this.bufOffset:])
+	this.offset += int64(n)
+	return n, nil
+}
+
+func (this *RemoteFile) buffered(offset int64) bool {
+	return offset >= this.bufOffset && offset < this.bufOffset+int64(len(this.buf))
+}
+
+// fill downloads ReadAheadSize bytes at offset into the buffer
+func (this *RemoteFile) fill(offset int64) error {
+	size := int64(this.ReadAheadSize)
+	if remain := this.info.FileSize - offset; size > remain {
+		size = remain
+	}
+	if cap(this.buf) < int(size) {
+		this.buf = make([]byte, size)
+	}
+	n, err := this.readAt(this.buf[:size], offset)
+	this.buf = this.buf[:n]
+	this.bufOffset = offset
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return err
+}
+
+// ReadAt never uses the read ahead buffer, it returns io.EOF if
+// off+len(p) is past the end of the file.
+func (this *RemoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	this.mu.Lock()
+	closed := this.closed
+	this.mu.Unlock()
+	if closed {
+		return 0, os.ErrClosed
+	}
+	return this.readAt(p, off)
+}
+
+func (this *RemoteFile) readAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%w: negative offset %d", ErrInvalidArgument, off)
+	}
+	if off >= this.info.FileSize {
+		return 0, io.EOF
+	}
+	size := int64(len(p))
+	if remain := this.info.FileSize - off; size > remain {
+		size = remain
+		err = io.EOF
+	}
+	if size == 0 {
+		return 0, err
+	}
+	w := &sliceWriter{p: p[:size]}
+	_, derr := this.client.DownloadExContext(this.ctx, this.fileId, w, off, size)
+	if derr != nil {
+		return w.n, derr
+	}
+	return w.n, err
+}
+
+// sliceWriter writes to a fixed slice
+type sliceWriter struct {
+	p []byte
+	n int
+}
+
+func (w *sliceWriter) Write(b []byte) (int, error) {
+	n := copy(w.p[w.n:], b)
+	w.n += n
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (this *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.offset
+	case io.SeekEnd:
+		offset += this.info.FileSize
+	default:
+		return 0, fmt.Errorf("%w: whence %d", ErrInvalidArgument, whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%w: seek to negative offset %d", ErrInvalidArgument, offset)
+	}
+	this.offset = offset
+	return offset, nil
+}
+
+// Close releases the read ahead buffer, the connections are not kept by
+// RemoteFile
+func (this *RemoteFile) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return os.ErrClosed
+	}
+	this.closed = true
+	this.buf = nil
+	return nil
+}
@@ -0,0 +1,81 @@
+package fdfs_client
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRemoteFile(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, _ := zw.Create(name)
+		w.Write(bytes.Repeat([]byte(name), 10000))
+	}
+	zw.Close()
+	data := zipBuf.Bytes()
+	remoteFileId, err := fdfsClient.UploadByBuffer(data, "zip")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err)
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+
+	file, err := fdfsClient.Open(remoteFileId)
+	if err != nil {
+		t.Fatal("Open error:", err)
+	}
+	defer file.Close()
+	if file.Size() != int64(len(data)) {
+		t.Fatalf("file size %d, expect %d", file.Size(), len(data))
+	}
+
+	// random access by archive/zip
+	zr, err := zip.NewReader(file, file.Size())
+	if err != nil {
+		t.Fatal("zip.NewReader error:", err)
+	}
+	if len(zr.File) != 2 || zr.File[1].Name != "b.txt" {
+		t.Fatal("zip entries are different")
+	}
+	rc, _ := zr.File[1].Open()
+	content, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(content, bytes.Repeat([]byte("b.txt"), 10000)) {
+		t.Fatal("zip entry content is different", err)
+	}
+
+	// sequential reads through the read ahead buffer
+	file.ReadAheadSize = 1000
+	if _, err = file.Seek(-int64(len(data))/2, io.SeekEnd); err != nil {
+		t.Fatal("Seek error:", err)
+	}
+	buf := make([]byte, 7)
+	got := []byte{}
+	for {
+		n, err := file.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Read error:", err)
+		}
+	}
+	if !bytes.Equal(got, data[len(data)-len(data)/2:]) {
+		t.Fatal("read content is different")
+	}
+
+	p := make([]byte, 100)
+	if n, err := file.ReadAt(p, int64(len(data))-10); n != 10 || err != io.EOF {
+		t.Fatalf("ReadAt past the end returns %d, %v, expect 10, io.EOF", n, err)
+	}
+	file.Close()
+	if _, err = file.Read(p); err != os.ErrClosed {
+		t.Fatalf("Read after Close returns %v, expect os.ErrClosed", err)
+	}
+}
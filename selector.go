@@ -0,0 +1,81 @@
+package fdfs_client
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// a server that could not be dialed is skipped for this long
+const DEFAULT_QUARANTINE_TIME = 30 * time.Second
+
+// Selector picks the server of a new connection of a ConnectionPool. The
+// servers in quarantine are not passed to it.
+type Selector interface {
+	// Select returns the index of a server in servers, which is never empty
+	Select(servers []ServerState) int
+}
+
+// ServerState is what a Selector knows about a server
+type ServerState struct {
+	// Addr is the host:port of the server
+	Addr string
+	// InUse is the number of connections to the server that are in use, Open
+	// also counts the idle ones
+	InUse int
+	Open  int
+}
+
+// RandomSelector picks a random server, it is the default
+type RandomSelector struct{}
+
+func (RandomSelector) Select(servers []ServerState) int {
+	return rand.Intn(len(servers))
+}
+
+// RoundRobinSelector picks the servers in turn
+type RoundRobinSelector struct {
+	next uint32
+}
+
+func (this *RoundRobinSelector) Select(servers []ServerState) int {
+	return int((atomic.AddUint32(&this.next, 1) - 1) % uint32(len(servers)))
+}
+
+// LeastInUseSelector picks the server with the fewest connections in use, the
+// first one on a tie
+type LeastInUseSelector struct{}
+
+func (LeastInUseSelector) Select(servers []ServerState) int {
+	best := 0
+	for i, s := range servers {
+		if s.InUse < servers[best].InUse {
+			best = i
+		}
+	}
+	return best
+}
+
+// endpoint is a server of a ConnectionPool, guarded by the mutex of the pool
+type endpoint struct {
+	addr  string
+	inUse int
+	open  int
+	// the server is in quarantine until downUntil after failed dials
+	failures  int
+	downUntil time.Time
+
+	// counters of PoolStats
+	dials              int64
+	dialFailures       int64
+	activeTestFailures int64
+	errorCloses        int64
+}
+
+func newEndpoints(addrs []string) []*endpoint {
+	endpoints := make([]*endpoint, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = &endpoint{addr: addr}
+	}
+	return endpoints
+}
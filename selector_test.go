@@ -0,0 +1,128 @@
+package fdfs_client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectors(t *testing.T) {
+	servers := []ServerState{
+		{Addr: "10.0.0.1:22122", InUse: 3},
+		{Addr: "10.0.0.2:22122", InUse: 1},
+		{Addr: "10.0.0.3:22123", InUse: 1},
+	}
+	rr := &RoundRobinSelector{}
+	for i := 0; i < 6; i++ {
+		if n := rr.Select(servers); n != i%3 {
+			t.Fatalf("round robin selects %d, expect %d", n, i%3)
+		}
+	}
+	if n := (LeastInUseSelector{}).Select(servers); n != 1 {
+		t.Fatalf("least in use selects %d, expect 1", n)
+	}
+	for i := 0; i < 10; i++ {
+		if n := (RandomSelector{}).Select(servers); n < 0 || n >= len(servers) {
+			t.Fatalf("random selects %d", n)
+		}
+	}
+}
+
+// deadAddr returns an address that refuses connections
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// firstSelector always picks the first server
+type firstSelector struct{}
+
+func (firstSelector) Select(servers []ServerState) int {
+	return 0
+}
+
+func TestConnectionPoolQuarantine(t *testing.T) {
+	dead := deadAddr(t)
+	pool, err := NewConnectionPoolWithAddrs([]string{dead, cluster.TrackerAddr()}, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	metrics := NewMetrics()
+	pool.Instrumentation = metrics
+	pool.Selector = firstSelector{}
+	dials := func(addr string) int64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.events[metricsKey{"dial", addr}]
+	}
+	get := func() net.Conn {
+		conn, err := pool.Get()
+		if err != nil {
+			t.Fatal("Get error:", err)
+		}
+		if addr := conn.RemoteAddr().String(); addr != cluster.TrackerAddr() {
+			t.Fatalf("connection to %s, expect %s", addr, cluster.TrackerAddr())
+		}
+		return conn
+	}
+
+	// the dead tracker is tried once, then skipped
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conns = append(conns, get())
+	}
+	if n := dials(dead); n != 1 {
+		t.Fatalf("dead tracker dialed %d times, expect 1", n)
+	}
+	pool.mu.Lock()
+	ep := pool.endpoints[0]
+	if ep.failures != 1 || !ep.downUntil.After(time.Now()) {
+		t.Fatalf("dead tracker is not in quarantine: %+v", ep)
+	}
+	if live := pool.endpoints[1]; live.open != 4 || live.inUse != 4 {
+		t.Fatalf("live tracker has %d open, %d in use connections, expect 4, 4", live.open, live.inUse)
+	}
+	// the quarantine is over, the dead tracker is probed again
+	ep.downUntil = time.Now()
+	pool.mu.Unlock()
+	conns = append(conns, get())
+	if n := dials(dead); n != 2 {
+		t.Fatalf("dead tracker dialed %d times after the quarantine, expect 2", n)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if ep.failures != 2 || !ep.downUntil.After(time.Now()) {
+		t.Fatalf("dead tracker is not in quarantine again: %+v", ep)
+	}
+	if live := pool.endpoints[1]; live.open != 5 || live.inUse != 0 {
+		t.Fatalf("live tracker has %d open, %d in use connections, expect 5, 0", live.open, live.inUse)
+	}
+}
+
+func TestTrackersOnDifferentPorts(t *testing.T) {
+	conf := NewConfig()
+	conf.TrackerServers = []string{deadAddr(t), cluster.TrackerAddr()}
+	conf.TrackerSelector = LeastInUseSelector{}
+	fdfsClient, err := NewFdfsClientFromConfig(conf)
+	if err != nil {
+		t.Fatal("NewFdfsClientFromConfig error:", err)
+	}
+	defer fdfsClient.Close()
+	fileId, err := fdfsClient.UploadByBuffer([]byte("different ports"), "txt")
+	if err != nil {
+		t.Fatal("UploadByBuffer error:", err)
+	}
+	if err = fdfsClient.DeleteFile(fileId); err != nil {
+		t.Fatal("DeleteFile error:", err)
+	}
+}
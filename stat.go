@@ -0,0 +1,187 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// |-group_name(17)-total_mb(8)-free_mb(8)-trunk_free_mb(8)-count(8)-storage_port(8)
+	//  -storage_http_port(8)-active_count(8)-current_write_server(8)-store_path_count(8)
+	//  -subdir_count_per_path(8)-current_trunk_file_id(8)-|
+	TRACKER_GROUP_STAT_SIZE = FDFS_GROUP_NAME_MAX_LEN + 1 + 11*8
+	// |-status(1)-id(16)-ip_addr(16)-domain_name(128)-src_id(16)-version(6)-join_time(8)
+	//  -up_time(8)-total_mb(8)-free_mb(8)-upload_priority(8)-store_path_count(8)
+	//  -subdir_count_per_path(8)-current_write_path(8)-storage_port(8)
+	//  -storage_http_port(8)-stat_buff(42*8)-if_trunk_server(1)-|
+	TRACKER_STORAGE_STAT_SIZE = 1 + FDFS_STORAGE_ID_MAX_SIZE + IP_ADDRESS_SIZE + FDFS_DOMAIN_NAME_MAX_LEN +
+		FDFS_STORAGE_ID_MAX_SIZE + FDFS_VERSION_SIZE + 10*8 + 42*8 + 1
+)
+
+type StorageStatus int8
+
+func (s StorageStatus) String() string {
+	switch s {
+	case FDFS_STORAGE_STATUS_INIT:
+		return "INIT"
+	case FDFS_STORAGE_STATUS_WAIT_SYNC:
+		return "WAIT_SYNC"
+	case FDFS_STORAGE_STATUS_SYNCING:
+		return "SYNCING"
+	case FDFS_STORAGE_STATUS_IP_CHANGED:
+		return "IP_CHANGED"
+	case FDFS_STORAGE_STATUS_DELETED:
+		return "DELETED"
+	case FDFS_STORAGE_STATUS_OFFLINE:
+		return "OFFLINE"
+	case FDFS_STORAGE_STATUS_ONLINE:
+		return "ONLINE"
+	case FDFS_STORAGE_STATUS_ACTIVE:
+		return "ACTIVE"
+	case FDFS_STORAGE_STATUS_RECOVERY:
+		return "RECOVERY"
+	case FDFS_STORAGE_STATUS_NONE:
+		return "NONE"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int8(s))
+}
+
+type GroupStat struct {
+	GroupName          string
+	TotalMB            int64
+	FreeMB             int64
+	TrunkFreeMB        int64
+	StorageCount       int64
+	StoragePort        int64
+	StorageHttpPort    int64
+	ActiveCount        int64
+	CurrentWriteServer int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentTrunkFileId int64
+}
+
+func (this *GroupStat) Unmarshal(data []byte) error {
+	if len(data) != TRACKER_GROUP_STAT_SIZE {
+		return fmt.Errorf("%w: group stat length %d is not match, expect: %d", ErrProtocol, len(data), TRACKER_GROUP_STAT_SIZE)
+	}
+	buff := bytes.NewBuffer(data)
+	this.GroupName, _ = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN+1)
+	for _, v := range []*int64{
+		&this.TotalMB, &this.FreeMB, &this.TrunkFreeMB, &this.StorageCount,
+		&this.StoragePort, &this.StorageHttpPort, &this.ActiveCount, &this.CurrentWriteServer,
+		&this.StorePathCount, &this.SubdirCountPerPath, &this.CurrentTrunkFileId,
+	} {
+		binary.Read(buff, binary.BigEndian, v)
+	}
+	return nil
+}
+
+// StorageCounters is the stat_buff of a storage, in wire order
+type StorageCounters struct {
+	TotalUploadCount       int64
+	SuccessUploadCount     int64
+	TotalAppendCount       int64
+	SuccessAppendCount     int64
+	TotalModifyCount       int64
+	SuccessModifyCount     int64
+	TotalTruncateCount     int64
+	SuccessTruncateCount   int64
+	TotalSetMetaCount      int64
+	SuccessSetMetaCount    int64
+	TotalDeleteCount       int64
+	SuccessDeleteCount     int64
+	TotalDownloadCount     int64
+	SuccessDownloadCount   int64
+	TotalGetMetaCount      int64
+	SuccessGetMetaCount    int64
+	TotalCreateLinkCount   int64
+	SuccessCreateLinkCount int64
+	TotalDeleteLinkCount   int64
+	SuccessDeleteLinkCount int64
+	TotalUploadBytes       int64
+	SuccessUploadBytes     int64
+	TotalAppendBytes       int64
+	SuccessAppendBytes     int64
+	TotalModifyBytes       int64
+	SuccessModifyBytes     int64
+	TotalDownloadBytes     int64
+	SuccessDownloadBytes   int64
+	TotalSyncInBytes       int64
+	SuccessSyncInBytes     int64
+	TotalSyncOutBytes      int64
+	SuccessSyncOutBytes    int64
+	TotalFileOpenCount     int64
+	SuccessFileOpenCount   int64
+	TotalFileReadCount     int64
+	SuccessFileReadCount   int64
+	TotalFileWriteCount    int64
+	SuccessFileWriteCount  int64
+}
+
+type StorageStat struct {
+	Status             StorageStatus
+	Id                 string
+	IpAddr             string
+	DomainName         string
+	SrcId              string
+	Version            string
+	JoinTime           time.Time
+	UpTime             time.Time
+	TotalMB            int64
+	FreeMB             int64
+	UploadPriority     int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentWritePath   int64
+	StoragePort        int64
+	StorageHttpPort    int64
+	StorageCounters
+	LastSourceUpdate    time.Time
+	LastSyncUpdate      time.Time
+	LastSyncedTimestamp time.Time
+	LastHeartBeatTime   time.Time
+	IsTrunkServer       bool
+}
+
+func (this *StorageStat) Unmarshal(data []byte) error {
+	if len(data) != TRACKER_STORAGE_STAT_SIZE {
+		return fmt.Errorf("%w: storage stat length %d is not match, expect: %d", ErrProtocol, len(data), TRACKER_STORAGE_STAT_SIZE)
+	}
+	buff := bytes.NewBuffer(data)
+	status, _ := buff.ReadByte()
+	this.Status = StorageStatus(status)
+	this.Id, _ = readCstr(buff, FDFS_STORAGE_ID_MAX_SIZE)
+	this.IpAddr, _ = readCstr(buff, IP_ADDRESS_SIZE)
+	this.DomainName, _ = readCstr(buff, FDFS_DOMAIN_NAME_MAX_LEN)
+	this.SrcId, _ = readCstr(buff, FDFS_STORAGE_ID_MAX_SIZE)
+	this.Version, _ = readCstr(buff, FDFS_VERSION_SIZE)
+	this.JoinTime = readTimestamp(buff)
+	this.UpTime = readTimestamp(buff)
+	for _, v := range []*int64{
+		&this.TotalMB, &this.FreeMB, &this.UploadPriority, &this.StorePathCount,
+		&this.SubdirCountPerPath, &this.CurrentWritePath, &this.StoragePort, &this.StorageHttpPort,
+	} {
+		binary.Read(buff, binary.BigEndian, v)
+	}
+	binary.Read(buff, binary.BigEndian, &this.StorageCounters)
+	this.LastSourceUpdate = readTimestamp(buff)
+	this.LastSyncUpdate = readTimestamp(buff)
+	this.LastSyncedTimestamp = readTimestamp(buff)
+	this.LastHeartBeatTime = readTimestamp(buff)
+	trunk, _ := buff.ReadByte()
+	this.IsTrunkServer = trunk != 0
+	return nil
+}
+
+// zero timestamps are returned as the zero time
+func readTimestamp(buff *bytes.Buffer) time.Time {
+	var ts int64
+	binary.Read(buff, binary.BigEndian, &ts)
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
@@ -2,9 +2,10 @@ package fdfs_client
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"time"
@@ -15,9 +16,22 @@ type StorageClient struct {
 	Port           int
 	GroupName      string
 	StorePathIndex int
+	// ConnectTimeout bounds the dial, 0 means the system default
+	ConnectTimeout time.Duration
+	// NetworkTimeout bounds every read and write, 0 means no limit
+	NetworkTimeout time.Duration
+	// Pool reuses connections to the storage, connections are dialed for
+	// every request if it is nil
+	Pool *StoragePool
+	// Instrumentation, if not nil, is told about every request
+	Instrumentation Instrumentation
 }
 
 func (this *StorageClient) UploadByFilename(filename string) (*FileId, error) {
+	return this.UploadByFilenameContext(context.Background(), filename)
+}
+
+func (this *StorageClient) UploadByFilenameContext(ctx context.Context, filename string) (*FileId, error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
 		return nil, err
@@ -30,23 +44,35 @@ func (this *StorageClient) UploadByFilename(filename string) (*FileId, error) {
 		return nil, err
 	}
 	defer file.Close()
-	return this.UploadEx(file, fileSize,
+	return this.UploadExContext(ctx, file, fileSize,
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
 func (this *StorageClient) UploadByBuffer(buf []byte, fileExtName string) (*FileId, error) {
+	return this.UploadByBufferContext(context.Background(), buf, fileExtName)
+}
+
+func (this *StorageClient) UploadByBufferContext(ctx context.Context, buf []byte, fileExtName string) (*FileId, error) {
 	bufferSize := len(buf)
 	bb := bytes.NewReader(buf)
-	return this.UploadEx(bb, int64(bufferSize),
+	return this.UploadExContext(ctx, bb, int64(bufferSize),
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
 func (this *StorageClient) UploadByReader(reader io.Reader, size int64, fileExtName string) (*FileId, error) {
-	return this.UploadEx(reader, size,
+	return this.UploadByReaderContext(context.Background(), reader, size, fileExtName)
+}
+
+func (this *StorageClient) UploadByReaderContext(ctx context.Context, reader io.Reader, size int64, fileExtName string) (*FileId, error) {
+	return this.UploadExContext(ctx, reader, size,
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
 func (this *StorageClient) UploadSlaveByFilename(filename string, prefixName string, masterFileId string) (*FileId, error) {
+	return this.UploadSlaveByFilenameContext(context.Background(), filename, prefixName, masterFileId)
+}
+
+func (this *StorageClient) UploadSlaveByFilenameContext(ctx context.Context, filename string, prefixName string, masterFileId string) (*FileId, error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
 		return nil, err
@@ -59,57 +85,101 @@ func (this *StorageClient) UploadSlaveByFilename(filename string, prefixName str
 		return nil, err
 	}
 	defer file.Close()
-	return this.UploadEx(file, fileSize,
+	return this.UploadExContext(ctx, file, fileSize,
+		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, masterFileId, prefixName, fileExtName)
+}
+
+func (this *StorageClient) UploadSlaveByBuffer(buf []byte, prefixName string, masterFileId string, fileExtName string) (*FileId, error) {
+	return this.UploadSlaveByBufferContext(context.Background(), buf, prefixName, masterFileId, fileExtName)
+}
+
+func (this *StorageClient) UploadSlaveByBufferContext(ctx context.Context, buf []byte, prefixName string, masterFileId string, fileExtName string) (*FileId, error) {
+	bufferSize := len(buf)
+	bb := bytes.NewReader(buf)
+	return this.UploadExContext(ctx, bb, int64(bufferSize),
+		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, masterFileId, prefixName, fileExtName)
+}
+
+func (this *StorageClient) UploadSlaveByReader(reader io.Reader, size int64, prefixName string, masterFileId string, fileExtName string) (*FileId, error) {
+	return this.UploadSlaveByReaderContext(context.Background(), reader, size, prefixName, masterFileId, fileExtName)
+}
+
+func (this *StorageClient) UploadSlaveByReaderContext(ctx context.Context, reader io.Reader, size int64, prefixName string, masterFileId string, fileExtName string) (*FileId, error) {
+	return this.UploadExContext(ctx, reader, size,
 		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, masterFileId, prefixName, fileExtName)
 }
 
-func (this *StorageClient) UploadSlaveByBuffer(buf []byte, remoteFileId string, fileExtName string) (*FileId, error) {
+func (this *StorageClient) UploadAppenderByFilename(filename string) (*FileId, error) {
+	return this.UploadAppenderByFilenameContext(context.Background(), filename)
+}
+
+func (this *StorageClient) UploadAppenderByFilenameContext(ctx context.Context, filename string) (*FileId, error) {
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fileSize := fileInfo.Size()
+	fileExtName := getFileExt(filename)
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return this.UploadExContext(ctx, file, fileSize,
+		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
+}
+
+func (this *StorageClient) UploadAppenderByBuffer(buf []byte, fileExtName string) (*FileId, error) {
+	return this.UploadAppenderByBufferContext(context.Background(), buf, fileExtName)
+}
+
+func (this *StorageClient) UploadAppenderByBufferContext(ctx context.Context, buf []byte, fileExtName string) (*FileId, error) {
 	bufferSize := len(buf)
 	bb := bytes.NewReader(buf)
-	return this.UploadEx(bb, int64(bufferSize),
-		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, "", remoteFileId, fileExtName)
-}
-
-//func (this *StorageClient) UploadAppenderByFilename(filename string, appenderFileId string) (*FileId, error) {
-//	fileInfo, err := os.Stat(filename)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	fileSize := fileInfo.Size()
-//	fileExtName := getFileExt(filename)
-//	file, err := os.Open(filename)
-//	if err != nil {
-//		return nil, err
-//	}
-//	defer file.Close()
-//
-//	return this.UploadEx(file, fileSize,
-//		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
-//}
-//
-//func (this *StorageClient) UploadAppenderByBuffer(buf []byte, fileExtName string) (*FileId, error) {
-//	bufferSize := len(buf)
-//	bb := bytes.NewReader(buf)
-//	return this.UploadEx(bb, int64(bufferSize), STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
-//}
+	return this.UploadExContext(ctx, bb, int64(bufferSize),
+		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
+}
+
+func (this *StorageClient) UploadAppenderByReader(reader io.Reader, size int64, fileExtName string) (*FileId, error) {
+	return this.UploadAppenderByReaderContext(context.Background(), reader, size, fileExtName)
+}
+
+func (this *StorageClient) UploadAppenderByReaderContext(ctx context.Context, reader io.Reader, size int64, fileExtName string) (*FileId, error) {
+	return this.UploadExContext(ctx, reader, size,
+		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
+}
 
 func (this *StorageClient) UploadEx(input io.Reader, size int64,
 	cmd int8, masterFilename string, prefixName string, fileExtName string) (*FileId, error) {
+	return this.UploadExContext(context.Background(), input, size, cmd, masterFilename, prefixName, fileExtName)
+}
+
+func (this *StorageClient) UploadExContext(ctx context.Context, input io.Reader, size int64,
+	cmd int8, masterFilename string, prefixName string, fileExtName string) (fid *FileId, err error) {
 
 	var (
 		conn        net.Conn
 		uploadSlave bool
 		headerLen   int64 = 15
 		reqBuf      []byte
-		err         error
 	)
+	defer func() { err = this.opError(cmd, masterFilename, err) }()
+	// the name of a slave file is the name of its master with the prefix
+	if cmd == STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE && prefixName == "" {
+		return nil, fmt.Errorf("%w: slave file prefix name must not be empty", ErrInvalidArgument)
+	}
 
-	conn, err = this.makeConn()
+	conn, err = this.makeConn(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, cmd, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
 
 	masterFilenameLen := int64(len(masterFilename))
 	if len(this.GroupName) > 0 && len(masterFilename) > 0 {
@@ -123,7 +193,10 @@ func (this *StorageClient) UploadEx(input io.Reader, size int64,
 		PkgLen: headerLen + int64(size),
 		Cmd:    cmd,
 	}
-	th.sendHeader(conn)
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
 
 	if uploadSlave {
 		req := UploadSlaveFileRequest{
@@ -145,51 +218,62 @@ func (this *StorageClient) UploadEx(input io.Reader, size int64,
 	if err != nil {
 		return nil, err
 	}
-	conn.Write(reqBuf)
+	_, err = conn.Write(reqBuf)
+	if err != nil {
+		return nil, err
+	}
 	_, err = io.CopyN(conn, input, size)
 
 	if err != nil {
 		return nil, err
 	}
 
-	th.recvHeader(conn)
-	if th.Status != 0 {
-		return nil, Errno{int(th.Status)}
+	err = th.recvResponse(conn, FDFS_GROUP_NAME_MAX_LEN+1, MAX_RESPONSE_BODY_LEN)
+	if err != nil {
+		return nil, err
 	}
-	recvBuff, recvSize, err := TcpRecvResponse(conn, th.PkgLen)
-	if recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
-		errmsg := "[-] Error: Storage response length is not match, "
-		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.PkgLen, recvSize)
-		return nil, errors.New(errmsg)
+	recvBuff, _, err := TcpRecvResponse(conn, th.PkgLen)
+	if err != nil {
+		return nil, err
 	}
 	ur := &FileId{}
 	err = ur.Unmarshal(recvBuff)
 	if err != nil {
-		errmsg := fmt.Sprintf("recvBuf can not unmarshal :%s", err.Error())
-		return nil, errors.New(errmsg)
+		return nil, err
 	}
 
 	return ur, nil
 }
 
 func (this *StorageClient) DeleteFile(remoteFilename string) error {
+	return this.DeleteFileContext(context.Background(), remoteFilename)
+}
+
+func (this *StorageClient) DeleteFileContext(ctx context.Context, remoteFilename string) (err error) {
 	var (
 		conn   net.Conn
 		reqBuf []byte
-		err    error
 	)
-	conn, err = this.makeConn()
-	defer conn.Close()
+	defer func() { err = this.opError(STORAGE_PROTO_CMD_DELETE_FILE, remoteFilename, err) }()
+	conn, err = this.makeConn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, STORAGE_PROTO_CMD_DELETE_FILE, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
 
 	fileNameLen := len(remoteFilename)
 	th := TrackerHeader{
 		Cmd:    STORAGE_PROTO_CMD_DELETE_FILE,
 		PkgLen: int64(FDFS_GROUP_NAME_MAX_LEN + fileNameLen),
 	}
-	th.sendHeader(conn)
+	err = th.sendHeader(conn)
+	if err != nil {
+		return err
+	}
 	fid := FileId{
 		GroupName: this.GroupName,
 		FileName:  remoteFilename,
@@ -198,36 +282,353 @@ func (this *StorageClient) DeleteFile(remoteFilename string) error {
 	if err != nil {
 		return err
 	}
-	conn.Write(reqBuf)
+	_, err = conn.Write(reqBuf)
+	if err != nil {
+		return err
+	}
+
+	return th.recvResponse(conn, 0, 0)
+}
+
+func (this *StorageClient) AppendByBuffer(appenderFilename string, buf []byte) error {
+	return this.AppendByBufferContext(context.Background(), appenderFilename, buf)
+}
+
+func (this *StorageClient) AppendByBufferContext(ctx context.Context, appenderFilename string, buf []byte) error {
+	return this.AppendByReaderContext(ctx, appenderFilename, bytes.NewReader(buf), int64(len(buf)))
+}
+
+func (this *StorageClient) AppendByReader(appenderFilename string, reader io.Reader, size int64) error {
+	return this.AppendByReaderContext(context.Background(), appenderFilename, reader, size)
+}
+
+func (this *StorageClient) AppendByReaderContext(ctx context.Context, appenderFilename string, reader io.Reader, size int64) error {
+	req := &AppendFileRequest{
+		FileSize:         size,
+		AppenderFilename: appenderFilename,
+	}
+	return this.updateAppender(ctx, STORAGE_PROTO_CMD_APPEND_FILE, appenderFilename, req, reader, size)
+}
+
+func (this *StorageClient) ModifyByBuffer(appenderFilename string, offset int64, buf []byte) error {
+	return this.ModifyByBufferContext(context.Background(), appenderFilename, offset, buf)
+}
+
+func (this *StorageClient) ModifyByBufferContext(ctx context.Context, appenderFilename string, offset int64, buf []byte) error {
+	return this.ModifyByReaderContext(ctx, appenderFilename, offset, bytes.NewReader(buf), int64(len(buf)))
+}
+
+func (this *StorageClient) ModifyByReader(appenderFilename string, offset int64, reader io.Reader, size int64) error {
+	return this.ModifyByReaderContext(context.Background(), appenderFilename, offset, reader, size)
+}
+
+func (this *StorageClient) ModifyByReaderContext(ctx context.Context, appenderFilename string, offset int64, reader io.Reader, size int64) error {
+	req := &ModifyFileRequest{
+		FileOffset:       offset,
+		FileSize:         size,
+		AppenderFilename: appenderFilename,
+	}
+	return this.updateAppender(ctx, STORAGE_PROTO_CMD_MODIFY_FILE, appenderFilename, req, reader, size)
+}
+
+func (this *StorageClient) TruncateFile(appenderFilename string, truncatedFileSize int64) error {
+	return this.TruncateFileContext(context.Background(), appenderFilename, truncatedFileSize)
+}
+
+func (this *StorageClient) TruncateFileContext(ctx context.Context, appenderFilename string, truncatedFileSize int64) error {
+	req := &TruncateFileRequest{
+		TruncatedFileSize: truncatedFileSize,
+		AppenderFilename:  appenderFilename,
+	}
+	return this.updateAppender(ctx, STORAGE_PROTO_CMD_TRUNCATE_FILE, appenderFilename, req, nil, 0)
+}
+
+func (this *StorageClient) RegenerateAppenderFilename(appenderFilename string) (*FileId, error) {
+	return this.RegenerateAppenderFilenameContext(context.Background(), appenderFilename)
+}
+
+// RegenerateAppenderFilenameContext turns an appender file into a normal file
+// with a new name, the storage must be V6.02 or later
+// #regenerate_fmt |-appender_filename(len)-|
+func (this *StorageClient) RegenerateAppenderFilenameContext(ctx context.Context, appenderFilename string) (fid *FileId, err error) {
+	var (
+		conn     net.Conn
+		recvBuff []byte
+	)
+	defer func() { err = this.opError(STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME, appenderFilename, err) }()
+	conn, err = this.makeConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
+	th := TrackerHeader{
+		Cmd:    STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME,
+		PkgLen: int64(len(appenderFilename)),
+	}
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(conn, appenderFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = th.recvResponse(conn, FDFS_GROUP_NAME_MAX_LEN+1, MAX_RESPONSE_BODY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.PkgLen)
+	if err != nil {
+		return nil, err
+	}
+	fid = &FileId{}
+	if err = fid.Unmarshal(recvBuff); err != nil {
+		return nil, err
+	}
+	return fid, nil
+}
+
+// updateAppender sends an append, modify or truncate request followed by
+// size bytes of input, the storage only answers with a status.
+func (this *StorageClient) updateAppender(ctx context.Context, cmd int8, appenderFilename string, req Request, input io.Reader, size int64) (err error) {
+	var (
+		conn   net.Conn
+		reqBuf []byte
+	)
+	defer func() { err = this.opError(cmd, appenderFilename, err) }()
+	conn, err = this.makeConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, cmd, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
+	reqBuf, err = req.Marshal()
+	if err != nil {
+		return err
+	}
+	th := TrackerHeader{
+		Cmd:    cmd,
+		PkgLen: int64(len(reqBuf)) + size,
+	}
+	err = th.sendHeader(conn)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(reqBuf)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		_, err = io.CopyN(conn, input, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return th.recvResponse(conn, 0, 0)
+}
+
+func (this *StorageClient) SetMetadata(remoteFilename string, metadata map[string]string, flag byte) error {
+	return this.SetMetadataContext(context.Background(), remoteFilename, metadata, flag)
+}
+
+func (this *StorageClient) SetMetadataContext(ctx context.Context, remoteFilename string, metadata map[string]string, flag byte) (err error) {
+	var (
+		conn   net.Conn
+		reqBuf []byte
+	)
+	defer func() { err = this.opError(STORAGE_PROTO_CMD_SET_METADATA, remoteFilename, err) }()
+	req := SetMetadataRequest{
+		Flag:      flag,
+		GroupName: this.GroupName,
+		FileName:  remoteFilename,
+		Metadata:  metadata,
+	}
+	reqBuf, err = req.Marshal()
+	if err != nil {
+		return err
+	}
 
-	th.recvHeader(conn)
-	if th.Status != 0 {
-//		fmt.Println("DeleteFile:", th.Status)
-		return Errno{int(th.Status)}
+	conn, err = this.makeConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, STORAGE_PROTO_CMD_SET_METADATA, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
+	th := TrackerHeader{
+		Cmd:    STORAGE_PROTO_CMD_SET_METADATA,
+		PkgLen: int64(len(reqBuf)),
+	}
+	err = th.sendHeader(conn)
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = conn.Write(reqBuf)
+	if err != nil {
+		return err
+	}
+
+	return th.recvResponse(conn, 0, 0)
+}
+
+func (this *StorageClient) GetMetadata(remoteFilename string) (map[string]string, error) {
+	return this.GetMetadataContext(context.Background(), remoteFilename)
+}
+
+func (this *StorageClient) GetMetadataContext(ctx context.Context, remoteFilename string) (metadata map[string]string, err error) {
+	var (
+		conn     net.Conn
+		reqBuf   []byte
+		recvBuff []byte
+	)
+	defer func() { err = this.opError(STORAGE_PROTO_CMD_GET_METADATA, remoteFilename, err) }()
+	conn, err = this.makeConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, STORAGE_PROTO_CMD_GET_METADATA, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
+	fid := FileId{
+		GroupName: this.GroupName,
+		FileName:  remoteFilename,
+	}
+	reqBuf, err = fid.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	th := TrackerHeader{
+		Cmd:    STORAGE_PROTO_CMD_GET_METADATA,
+		PkgLen: int64(len(reqBuf)),
+	}
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(reqBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = th.recvResponse(conn, 0, MAX_RESPONSE_BODY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.PkgLen)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalMetadata(recvBuff), nil
+}
+
+func (this *StorageClient) QueryFileInfo(remoteFilename string) (*FileInfo, error) {
+	return this.QueryFileInfoContext(context.Background(), remoteFilename)
+}
+
+func (this *StorageClient) QueryFileInfoContext(ctx context.Context, remoteFilename string) (info *FileInfo, err error) {
+	var (
+		conn     net.Conn
+		reqBuf   []byte
+		recvBuff []byte
+	)
+	defer func() { err = this.opError(STORAGE_PROTO_CMD_QUERY_FILE_INFO, remoteFilename, err) }()
+	conn, err = this.makeConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, STORAGE_PROTO_CMD_QUERY_FILE_INFO, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
+	fid := FileId{
+		GroupName: this.GroupName,
+		FileName:  remoteFilename,
+	}
+	reqBuf, err = fid.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	th := TrackerHeader{
+		Cmd:    STORAGE_PROTO_CMD_QUERY_FILE_INFO,
+		PkgLen: int64(len(reqBuf)),
+	}
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(reqBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = th.recvResponse(conn, STORAGE_QUERY_FILE_INFO_BODY_LEN, STORAGE_QUERY_FILE_INFO_BODY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.PkgLen)
+	if err != nil {
+		return nil, err
+	}
+	info = &FileInfo{}
+	err = info.Unmarshal(recvBuff)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
 }
 
 //如果下载全部文件,那么downloadSize设为0
 func (this *StorageClient) DownloadEx(remoteFilename string, output io.Writer, offset int64, downloadSize int64) (size int64, e error) {
+	return this.DownloadExContext(context.Background(), remoteFilename, output, offset, downloadSize)
+}
+
+func (this *StorageClient) DownloadExContext(ctx context.Context, remoteFilename string, output io.Writer, offset int64, downloadSize int64) (size int64, e error) {
 
 	var (
 		conn   net.Conn
 		reqBuf []byte
 	)
+	defer func() { e = this.opError(STORAGE_PROTO_CMD_DOWNLOAD_FILE, remoteFilename, e) }()
 	size = 0
-	conn, e = this.makeConn()
-	defer conn.Close()
+	conn, e = this.makeConn(ctx)
 	if e != nil {
 		return
 	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, STORAGE_PROTO_CMD_DOWNLOAD_FILE, conn)
+	defer func() { rpcDone(e) }()
+	finish := watchContext(ctx, conn)
+	defer func() { e = finish(e) }()
 
 	th := TrackerHeader{
 		Cmd:    STORAGE_PROTO_CMD_DOWNLOAD_FILE,
 		PkgLen: int64(FDFS_PROTO_PKG_LEN_SIZE*2 + FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename)),
 	}
 
-	th.sendHeader(conn)
+	e = th.sendHeader(conn)
+	if e != nil {
+		return
+	}
 
 	req := DownloadFileRequest{
 		Offset:       offset,
@@ -239,38 +640,66 @@ func (this *StorageClient) DownloadEx(remoteFilename string, output io.Writer, o
 	if e != nil {
 		return
 	}
-	conn.Write(reqBuf)
-
-	th.recvHeader(conn)
-	if th.Status != 0 {
-		e = Errno{int(th.Status)}
-//		fmt.Println("DownloadEx,", e)
+	_, e = conn.Write(reqBuf)
+	if e != nil {
 		return
 	}
-	size, e = io.CopyN(output, conn, th.PkgLen)
 
-	if size < downloadSize {
-		errmsg := "[-] Error: Storage response length is not match, "
-		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.PkgLen, size)
-		e = errors.New(errmsg)
+	// the storage sends the rest of the file if downloadSize is 0
+	maxLen := int64(math.MaxInt64)
+	if downloadSize > 0 {
+		maxLen = downloadSize
+	}
+	e = th.recvResponse(conn, 0, maxLen)
+	if e != nil {
+		//		fmt.Println("DownloadEx,", e)
+		return
 	}
+	// the storage cuts a range beyond the end of the file at the end
+	size, e = io.CopyN(output, conn, th.PkgLen)
 	return
 }
 
 func (this *StorageClient) Download(remoteFilename string, output io.Writer) (size int64, e error) {
-	return this.DownloadEx(remoteFilename, output, 0, 0)
+	return this.DownloadContext(context.Background(), remoteFilename, output)
+}
+
+func (this *StorageClient) DownloadContext(ctx context.Context, remoteFilename string, output io.Writer) (size int64, e error) {
+	return this.DownloadExContext(ctx, remoteFilename, output, 0, 0)
 }
 
 func (this *StorageClient) DownloadToFile(remoteFilename string, localFilename string) (size int64, e error) {
+	return this.DownloadToFileContext(context.Background(), remoteFilename, localFilename)
+}
+
+func (this *StorageClient) DownloadToFileContext(ctx context.Context, remoteFilename string, localFilename string) (size int64, e error) {
 	file, err := os.Create(localFilename)
 	if err != nil {
 		return 0, err
 	}
 	defer file.Close()
-	return this.Download(remoteFilename, file)
+	return this.DownloadContext(ctx, remoteFilename, file)
+}
+
+// opError wraps err with the request, remoteFilename is empty if the request
+// has no file
+func (this *StorageClient) opError(cmd int8, remoteFilename string, err error) error {
+	fileId := ""
+	if remoteFilename != "" {
+		fileId = this.GroupName + "/" + remoteFilename
+	}
+	return opError(cmd, storageAddr(this.IpAddr, this.Port), fileId, err)
 }
 
-func (this *StorageClient) makeConn() (net.Conn, error) {
-	addr := fmt.Sprintf("%s:%d", this.IpAddr, this.Port)
-	return net.DialTimeout("tcp", addr, time.Minute)
+func (this *StorageClient) makeConn(ctx context.Context) (net.Conn, error) {
+	addr := storageAddr(this.IpAddr, this.Port)
+	if this.Pool != nil {
+		return this.Pool.GetContext(ctx, addr)
+	}
+	conn, err := dialContext(ctx, addr, this.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// storage connections are not pooled, PoolConn.Close closes them
+	return &PoolConn{Conn: conn, timeout: this.NetworkTimeout}, nil
 }
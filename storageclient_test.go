@@ -0,0 +1,67 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordRequest starts a storage that records the body of one request and
+// answers it with status
+func recordRequest(t *testing.T, status int8) (addr string, bodies chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	bodies = make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 10)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		th := &TrackerHeader{}
+		th.Unmarshal(buf)
+		body := make([]byte, th.PkgLen)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		bodies <- body
+		resp, _ := (&TrackerHeader{Cmd: STORAGE_PROTO_CMD_RESP, Status: status}).Marshal()
+		conn.Write(resp)
+	}()
+	return ln.Addr().String(), bodies
+}
+
+func TestUploadSlaveRequest(t *testing.T) {
+	addr, bodies := recordRequest(t, 22)
+	host, port, _ := splitHostPort(addr)
+	store := &StorageClient{IpAddr: host, Port: port, GroupName: "group1"}
+	master := "M00/00/00/master.txt"
+	if _, err := store.UploadSlaveByBuffer([]byte("slave"), "_small", master, "txt"); err == nil {
+		t.Fatal("UploadSlaveByBuffer succeeds with an EINVAL response")
+	}
+
+	// #slave_fmt |-master_len(8)-file_size(8)-prefix_name(16)-file_ext_name(6)
+	//       #           -master_name(master_filename_len)-file_content-|
+	body := <-bodies
+	if len(body) != 38+len(master)+len("slave") {
+		t.Fatalf("request has %d bytes, expect a slave upload of %s", len(body), master)
+	}
+	if n := binary.BigEndian.Uint64(body[:8]); n != uint64(len(master)) {
+		t.Errorf("master name length %d, expect %d", n, len(master))
+	}
+	if prefix := string(bytes.TrimRight(body[16:32], "\x00")); prefix != "_small" {
+		t.Errorf("prefix name %q, expect _small", prefix)
+	}
+	if name := string(body[38 : 38+len(master)]); name != master {
+		t.Errorf("master name %q, expect %q", name, master)
+	}
+}
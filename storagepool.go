@@ -0,0 +1,125 @@
+package fdfs_client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_STORAGE_MAX_IDLE  = 10
+	DEFAULT_STORAGE_MAX_CONNS = 150
+)
+
+// StoragePool keeps a ConnectionPool for each storage server, keyed by ip:port.
+// Idle connections are checked with FDFS_PROTO_CMD_ACTIVE_TEST before reuse.
+type StoragePool struct {
+	// MaxIdle is the number of idle connections kept per storage
+	MaxIdle int
+	// MaxConns is the number of connections per storage
+	MaxConns int
+	// ConnectTimeout bounds the dial of a connection
+	ConnectTimeout time.Duration
+	// NetworkTimeout bounds every read and write, 0 means no limit
+	NetworkTimeout time.Duration
+	// Instrumentation, if not nil, is told about the connections of the pools
+	Instrumentation Instrumentation
+	// IdleTimeout, MaxLifetime, HealthCheckInterval and TestOnGet are those of
+	// the pool of every storage, see ConnectionPool
+	IdleTimeout         time.Duration
+	MaxLifetime         time.Duration
+	HealthCheckInterval time.Duration
+	TestOnGet           bool
+
+	mu     sync.Mutex
+	pools  map[string]*ConnectionPool
+	closed bool
+}
+
+func NewStoragePool(maxIdle int, maxConns int) (*StoragePool, error) {
+	if maxIdle < 0 || maxConns <= 0 || maxIdle > maxConns {
+		return nil, fmt.Errorf("%w: invalid conns settings", ErrInvalidArgument)
+	}
+	return &StoragePool{
+		MaxIdle:        maxIdle,
+		MaxConns:       maxConns,
+		ConnectTimeout: time.Minute,
+		TestOnGet:      true,
+		pools:          make(map[string]*ConnectionPool),
+	}, nil
+}
+
+func (this *StoragePool) Get(addr string) (net.Conn, error) {
+	return this.GetContext(context.Background(), addr)
+}
+
+// GetContext returns a pooled connection to the storage at addr (ip:port)
+func (this *StoragePool) GetContext(ctx context.Context, addr string) (net.Conn, error) {
+	pool, err := this.hostPool(addr)
+	if err != nil {
+		return nil, err
+	}
+	return pool.GetContext(ctx)
+}
+
+func (this *StoragePool) hostPool(addr string) (*ConnectionPool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return nil, ErrClosed
+	}
+	if pool, ok := this.pools[addr]; ok {
+		return pool, nil
+	}
+
+	if _, _, err := splitHostPort(addr); err != nil {
+		return nil, err
+	}
+	pool := &ConnectionPool{
+		Addrs:           []string{addr},
+		MaxConns:        this.MaxConns,
+		ConnectTimeout:  this.ConnectTimeout,
+		NetworkTimeout:  this.NetworkTimeout,
+		Instrumentation: this.Instrumentation,
+		IdleTimeout:     this.IdleTimeout,
+		MaxLifetime:     this.MaxLifetime,
+		TestOnGet:       this.TestOnGet,
+		endpoints:       newEndpoints([]string{addr}),
+		maxIdle:         this.MaxIdle,
+
+		HealthCheckInterval: this.HealthCheckInterval,
+	}
+	this.pools[addr] = pool
+	return pool, nil
+}
+
+// SetInstrumentation sets the Instrumentation of the pool and of the pools of
+// every storage
+func (this *StoragePool) SetInstrumentation(inst Instrumentation) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.Instrumentation = inst
+	for _, pool := range this.pools {
+		pool.SetInstrumentation(inst)
+	}
+}
+
+func (this *StoragePool) Close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return
+	}
+	this.closed = true
+	for addr, pool := range this.pools {
+		pool.Close()
+		delete(this.pools, addr)
+	}
+}
+
+func storageAddr(ipAddr string, port int) string {
+	return net.JoinHostPort(ipAddr, strconv.Itoa(port))
+}
@@ -2,35 +2,53 @@ package fdfs_client
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"net"
 )
 
 type TrackerClient struct {
 	Pool *ConnectionPool
+	// StoragePool is handed to the StorageClients returned by queries
+	StoragePool *StoragePool
+	// Instrumentation, if not nil, is told about every request, it is handed
+	// to the StorageClients too
+	Instrumentation Instrumentation
 }
 
 func (this *TrackerClient) QueryStorageStoreWithoutGroup() (*StorageClient, error) {
+	return this.QueryStorageStoreWithoutGroupContext(context.Background())
+}
+
+func (this *TrackerClient) QueryStorageStoreWithoutGroupContext(ctx context.Context) (store *StorageClient, err error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
-		err      error
 	)
+	defer func() { err = this.opError(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, conn, "", err) }()
 
-	conn, err = this.Pool.Get()
+	conn, err = this.Pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
 
 	th := TrackerHeader{
 		Cmd: TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE,
 	}
-	th.sendHeader(conn)
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
 
-	th.recvHeader(conn)
-	if th.Status != 0 {
-		return nil, Errno{int(th.Status)}
+	err = th.recvResponse(conn, TRACKER_QUERY_STORAGE_STORE_BODY_LEN, TRACKER_QUERY_STORAGE_STORE_BODY_LEN)
+	if err != nil {
+		return nil, err
 	}
 
 	var (
@@ -49,26 +67,37 @@ func (this *TrackerClient) QueryStorageStoreWithoutGroup() (*StorageClient, erro
 	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
 	binary.Read(buff, binary.BigEndian, &port)
 	binary.Read(buff, binary.BigEndian, &storePathIndex)
-	return &StorageClient{ipAddr, int(port), groupName, int(storePathIndex)}, nil
+	return this.newStorageClient(groupName, ipAddr, int(port), int(storePathIndex)), nil
 }
 
 func (this *TrackerClient) QueryStorageStoreWithGroup(groupName string) (*StorageClient, error) {
+	return this.QueryStorageStoreWithGroupContext(context.Background(), groupName)
+}
+
+func (this *TrackerClient) QueryStorageStoreWithGroupContext(ctx context.Context, groupName string) (store *StorageClient, err error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
-		err      error
 	)
-	conn, err = this.Pool.Get()
-	defer conn.Close()
+	defer func() { err = this.opError(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE, conn, "", err) }()
+	conn, err = this.Pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
 
 	th := TrackerHeader{
 		Cmd:    TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE,
 		PkgLen: int64(FDFS_GROUP_NAME_MAX_LEN),
 	}
-	th.sendHeader(conn)
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
 
 	groupBuffer := make([]byte, 16)
 	// 16 bit groupName
@@ -79,9 +108,9 @@ func (this *TrackerClient) QueryStorageStoreWithGroup(groupName string) (*Storag
 		return nil, err
 	}
 
-	th.recvHeader(conn)
-	if th.Status != 0 {
-		return nil, Errno{int(th.Status)}
+	err = th.recvResponse(conn, TRACKER_QUERY_STORAGE_STORE_BODY_LEN, TRACKER_QUERY_STORAGE_STORE_BODY_LEN)
+	if err != nil {
+		return nil, err
 	}
 
 	var (
@@ -99,34 +128,135 @@ func (this *TrackerClient) QueryStorageStoreWithGroup(groupName string) (*Storag
 	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
 	binary.Read(buff, binary.BigEndian, &port)
 	binary.Read(buff, binary.BigEndian, &storePathIndex)
-	return &StorageClient{ipAddr, int(port), groupName, int(storePathIndex)}, nil
+	return this.newStorageClient(groupName, ipAddr, int(port), int(storePathIndex)), nil
+}
+
+func (this *TrackerClient) QueryStorageStoreWithoutGroupAll() ([]*StorageClient, error) {
+	return this.QueryStorageStoreWithoutGroupAllContext(context.Background())
+}
+
+// QueryStorageStoreWithoutGroupAllContext returns every writable storage of the group the tracker picks
+func (this *TrackerClient) QueryStorageStoreWithoutGroupAllContext(ctx context.Context) ([]*StorageClient, error) {
+	recvBuff, addr, err := this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ALL, nil)
+	if err != nil {
+		return nil, err
+	}
+	stores, err := this.unmarshalStoreList(recvBuff)
+	return stores, opError(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ALL, addr, "", err)
+}
+
+func (this *TrackerClient) QueryStorageStoreWithGroupAll(groupName string) ([]*StorageClient, error) {
+	return this.QueryStorageStoreWithGroupAllContext(context.Background(), groupName)
+}
+
+// QueryStorageStoreWithGroupAllContext returns every writable storage of groupName
+func (this *TrackerClient) QueryStorageStoreWithGroupAllContext(ctx context.Context, groupName string) ([]*StorageClient, error) {
+	reqBuf := make([]byte, FDFS_GROUP_NAME_MAX_LEN)
+	copy(reqBuf, groupName)
+	recvBuff, addr, err := this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ALL, reqBuf)
+	if err != nil {
+		return nil, err
+	}
+	stores, err := this.unmarshalStoreList(recvBuff)
+	return stores, opError(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ALL, addr, "", err)
+}
+
+// #recv_fmt |-group_name(16)-[ipaddr(16-1)-port(8)]*count-store_path_index(1)|
+func (this *TrackerClient) unmarshalStoreList(recvBuff []byte) ([]*StorageClient, error) {
+	const serverLen = IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE
+	bodyLen := len(recvBuff) - FDFS_GROUP_NAME_MAX_LEN - 1
+	if bodyLen < serverLen || bodyLen%serverLen != 0 {
+		return nil, fmt.Errorf("%w: store list length %d is invalid", ErrProtocol, len(recvBuff))
+	}
+	buff := bytes.NewBuffer(recvBuff)
+	groupName, _ := readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
+	storePathIndex := recvBuff[len(recvBuff)-1]
+	stores := make([]*StorageClient, bodyLen/serverLen)
+	for i := range stores {
+		var port int64
+		ipAddr, _ := readCstr(buff, IP_ADDRESS_SIZE-1)
+		binary.Read(buff, binary.BigEndian, &port)
+		stores[i] = this.newStorageClient(groupName, ipAddr, int(port), int(storePathIndex))
+	}
+	return stores, nil
 }
 
 func (this *TrackerClient) QueryStorageUpdate(fileId *FileId) (*StorageClient, error) {
-	return this.QueryStorage(fileId, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE)
+	return this.QueryStorageUpdateContext(context.Background(), fileId)
+}
+
+func (this *TrackerClient) QueryStorageUpdateContext(ctx context.Context, fileId *FileId) (*StorageClient, error) {
+	return this.QueryStorageContext(ctx, fileId, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE)
 }
 
 func (this *TrackerClient) QueryStorageFetch(fileId *FileId) (*StorageClient, error) {
-	return this.QueryStorage(fileId, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE)
+	return this.QueryStorageFetchContext(context.Background(), fileId)
+}
+
+func (this *TrackerClient) QueryStorageFetchContext(ctx context.Context, fileId *FileId) (*StorageClient, error) {
+	return this.QueryStorageContext(ctx, fileId, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE)
+}
+
+func (this *TrackerClient) QueryStorageFetchAll(fileId *FileId) ([]*StorageClient, error) {
+	return this.QueryStorageFetchAllContext(context.Background(), fileId)
+}
+
+// QueryStorageFetchAllContext returns every storage holding a replica of fileId
+func (this *TrackerClient) QueryStorageFetchAllContext(ctx context.Context, fileId *FileId) ([]*StorageClient, error) {
+	// #query_fmt: |-group_name(16)-filename(file_name_len)-|
+	reqBuf, _ := fileId.Marshal()
+	recvBuff, addr, err := this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL, reqBuf)
+	if err != nil {
+		return nil, err
+	}
+	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-[ipaddr(16-1)]*(count-1)-|
+	bodyLen := len(recvBuff) - TRACKER_QUERY_STORAGE_FETCH_BODY_LEN
+	if bodyLen < 0 || bodyLen%(IP_ADDRESS_SIZE-1) != 0 {
+		err = fmt.Errorf("%w: fetch list length %d is invalid", ErrProtocol, len(recvBuff))
+		return nil, opError(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL, addr, fileId.GetFileIdStr(), err)
+	}
+	var port int64
+	buff := bytes.NewBuffer(recvBuff)
+	groupName, _ := readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
+	ipAddr, _ := readCstr(buff, IP_ADDRESS_SIZE-1)
+	binary.Read(buff, binary.BigEndian, &port)
+	stores := []*StorageClient{this.newStorageClient(groupName, ipAddr, int(port), 0)}
+	for i := 0; i < bodyLen/(IP_ADDRESS_SIZE-1); i++ {
+		// the other replicas listen on the same port
+		ipAddr, _ = readCstr(buff, IP_ADDRESS_SIZE-1)
+		stores = append(stores, this.newStorageClient(groupName, ipAddr, int(port), 0))
+	}
+	return stores, nil
 }
 
 func (this *TrackerClient) QueryStorage(fileId *FileId, cmd int8) (*StorageClient, error) {
+	return this.QueryStorageContext(context.Background(), fileId, cmd)
+}
+
+func (this *TrackerClient) QueryStorageContext(ctx context.Context, fileId *FileId, cmd int8) (store *StorageClient, err error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
-		err      error
 	)
+	defer func() { err = this.opError(cmd, conn, fileId.GetFileIdStr(), err) }()
 
-	conn, err = this.Pool.Get()
-	defer conn.Close()
+	conn, err = this.Pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
+	rpcDone := startRpc(ctx, this.Instrumentation, cmd, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
 
 	th := TrackerHeader{}
 	th.PkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(fileId.FileName))
 	th.Cmd = cmd
-	th.sendHeader(conn)
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, err
+	}
 
 	// #query_fmt: |-group_name(16)-filename(file_name_len)-|
 	queryBuffer := make([]byte, th.PkgLen)
@@ -139,9 +269,9 @@ func (this *TrackerClient) QueryStorage(fileId *FileId, cmd int8) (*StorageClien
 		return nil, err
 	}
 
-	th.recvHeader(conn)
-	if th.Status != 0 {
-		return nil, Errno{int(th.Status)}
+	err = th.recvResponse(conn, TRACKER_QUERY_STORAGE_FETCH_BODY_LEN, TRACKER_QUERY_STORAGE_FETCH_BODY_LEN)
+	if err != nil {
+		return nil, err
 	}
 
 	var (
@@ -159,5 +289,165 @@ func (this *TrackerClient) QueryStorage(fileId *FileId, cmd int8) (*StorageClien
 	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
 	binary.Read(buff, binary.BigEndian, &port)
 	binary.Read(buff, binary.BigEndian, &storePathIndex)
-	return &StorageClient{ipAddr, int(port), groupName, int(storePathIndex)}, nil
+	return this.newStorageClient(groupName, ipAddr, int(port), int(storePathIndex)), nil
+}
+
+// opError wraps err with the request and the tracker of conn, conn is nil if
+// no connection could be made
+func (this *TrackerClient) opError(cmd int8, conn net.Conn, fileId string, err error) error {
+	addr := ""
+	if conn != nil {
+		addr = conn.RemoteAddr().String()
+	}
+	return opError(cmd, addr, fileId, err)
+}
+
+// storage connections inherit the timeouts of the tracker pool
+func (this *TrackerClient) newStorageClient(groupName string, ipAddr string, port int, storePathIndex int) *StorageClient {
+	return &StorageClient{
+		IpAddr:          ipAddr,
+		Port:            port,
+		GroupName:       groupName,
+		StorePathIndex:  storePathIndex,
+		ConnectTimeout:  this.Pool.ConnectTimeout,
+		NetworkTimeout:  this.Pool.NetworkTimeout,
+		Pool:            this.StoragePool,
+		Instrumentation: this.Instrumentation,
+	}
+}
+
+func (this *TrackerClient) ListOneGroup(groupName string) (*GroupStat, error) {
+	return this.ListOneGroupContext(context.Background(), groupName)
+}
+
+func (this *TrackerClient) ListOneGroupContext(ctx context.Context, groupName string) (*GroupStat, error) {
+	reqBuf := make([]byte, FDFS_GROUP_NAME_MAX_LEN)
+	copy(reqBuf, groupName)
+	recvBuff, addr, err := this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVER_LIST_ONE_GROUP, reqBuf)
+	if err != nil {
+		return nil, err
+	}
+	stat := &GroupStat{}
+	if err = stat.Unmarshal(recvBuff); err != nil {
+		return nil, opError(TRACKER_PROTO_CMD_SERVER_LIST_ONE_GROUP, addr, "", err)
+	}
+	return stat, nil
+}
+
+func (this *TrackerClient) ListGroups() ([]*GroupStat, error) {
+	return this.ListGroupsContext(context.Background())
+}
+
+func (this *TrackerClient) ListGroupsContext(ctx context.Context) ([]*GroupStat, error) {
+	recvBuff, addr, err := this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(recvBuff)%TRACKER_GROUP_STAT_SIZE != 0 {
+		err = fmt.Errorf("%w: group stat length %d is not a multiple of %d", ErrProtocol, len(recvBuff), TRACKER_GROUP_STAT_SIZE)
+		return nil, opError(TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS, addr, "", err)
+	}
+	stats := make([]*GroupStat, len(recvBuff)/TRACKER_GROUP_STAT_SIZE)
+	for i := range stats {
+		stats[i] = &GroupStat{}
+		stats[i].Unmarshal(recvBuff[i*TRACKER_GROUP_STAT_SIZE : (i+1)*TRACKER_GROUP_STAT_SIZE])
+	}
+	return stats, nil
+}
+
+// if storageId is empty, all storages of the group are listed
+func (this *TrackerClient) ListStorages(groupName string, storageId string) ([]*StorageStat, error) {
+	return this.ListStoragesContext(context.Background(), groupName, storageId)
+}
+
+func (this *TrackerClient) ListStoragesContext(ctx context.Context, groupName string, storageId string) ([]*StorageStat, error) {
+	reqBuf, err := groupStorageBody(groupName, storageId)
+	if err != nil {
+		return nil, opError(TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, "", "", err)
+	}
+	recvBuff, addr, err := this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, reqBuf)
+	if err != nil {
+		return nil, err
+	}
+	if len(recvBuff)%TRACKER_STORAGE_STAT_SIZE != 0 {
+		err = fmt.Errorf("%w: storage stat length %d is not a multiple of %d", ErrProtocol, len(recvBuff), TRACKER_STORAGE_STAT_SIZE)
+		return nil, opError(TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, addr, "", err)
+	}
+	stats := make([]*StorageStat, len(recvBuff)/TRACKER_STORAGE_STAT_SIZE)
+	for i := range stats {
+		stats[i] = &StorageStat{}
+		stats[i].Unmarshal(recvBuff[i*TRACKER_STORAGE_STAT_SIZE : (i+1)*TRACKER_STORAGE_STAT_SIZE])
+	}
+	return stats, nil
+}
+
+// storageId is the storage id or ip address of the storage
+func (this *TrackerClient) DeleteStorage(groupName string, storageId string) error {
+	return this.DeleteStorageContext(context.Background(), groupName, storageId)
+}
+
+func (this *TrackerClient) DeleteStorageContext(ctx context.Context, groupName string, storageId string) error {
+	if storageId == "" {
+		err := fmt.Errorf("%w: storage id of group %s must not be empty", ErrInvalidArgument, groupName)
+		return opError(TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE, "", "", err)
+	}
+	reqBuf, err := groupStorageBody(groupName, storageId)
+	if err != nil {
+		return opError(TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE, "", "", err)
+	}
+	_, _, err = this.sendRecv(ctx, TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE, reqBuf)
+	return err
+}
+
+// #body_fmt |-group_name(16)-storage_id(id_len)-|
+func groupStorageBody(groupName string, storageId string) ([]byte, error) {
+	if len(storageId) >= FDFS_STORAGE_ID_MAX_SIZE {
+		return nil, fmt.Errorf("%w: storage id %s of group %s is too long", ErrInvalidArgument, storageId, groupName)
+	}
+	buf := make([]byte, FDFS_GROUP_NAME_MAX_LEN+len(storageId))
+	copy(buf, groupName)
+	copy(buf[FDFS_GROUP_NAME_MAX_LEN:], storageId)
+	return buf, nil
+}
+
+// sendRecv sends a request and returns the body of the response, and the
+// address of the tracker to report the errors of decoding the body
+func (this *TrackerClient) sendRecv(ctx context.Context, cmd int8, reqBuf []byte) (recvBuff []byte, addr string, err error) {
+	var conn net.Conn
+	defer func() { err = this.opError(cmd, conn, "", err) }()
+	conn, err = this.Pool.GetContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	addr = conn.RemoteAddr().String()
+	rpcDone := startRpc(ctx, this.Instrumentation, cmd, conn)
+	defer func() { rpcDone(err) }()
+	finish := watchContext(ctx, conn)
+	defer func() { err = finish(err) }()
+
+	th := TrackerHeader{
+		Cmd:    cmd,
+		PkgLen: int64(len(reqBuf)),
+	}
+	err = th.sendHeader(conn)
+	if err != nil {
+		return nil, addr, err
+	}
+	if len(reqBuf) > 0 {
+		_, err = conn.Write(reqBuf)
+		if err != nil {
+			return nil, addr, err
+		}
+	}
+
+	err = th.recvResponse(conn, 0, MAX_RESPONSE_BODY_LEN)
+	if err != nil {
+		return nil, addr, err
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.PkgLen)
+	if err != nil {
+		return nil, addr, err
+	}
+	return recvBuff, addr, nil
 }
@@ -0,0 +1,266 @@
+package fdfs_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DEFAULT_UPLOAD_CHUNK_SIZE     = 8 << 20
+	DEFAULT_UPLOAD_MAX_RETRIES    = 3
+	DEFAULT_UPLOAD_RETRY_INTERVAL = time.Second
+)
+
+// UploadSession uploads a large file to an appender file, chunk by chunk. The
+// progress is saved to a checkpoint file after every chunk, so that an upload
+// interrupted by a network error or a restart resumes from the last committed
+// offset instead of starting over.
+type UploadSession struct {
+	client         *FdfsClient
+	checkpointFile string
+	checkpoint     uploadCheckpoint
+
+	// ChunkSize is the size of every append request
+	ChunkSize int64
+	// MaxRetries is the number of times a chunk is sent again after a
+	// retryable error, see IsRetryable
+	MaxRetries    int
+	RetryInterval time.Duration
+}
+
+// #checkpoint_fmt {"file_id": "group1/M00/...", "offset": 1024, "ext_name": "mp4"}
+type uploadCheckpoint struct {
+	FileId  string `json:"file_id"`
+	Offset  int64  `json:"offset"`
+	ExtName string `json:"ext_name"`
+}
+
+// NewUploadSession starts an upload, or resumes the one saved in
+// checkpointFile if it exists. The checkpoint is kept in memory only if
+// checkpointFile is empty.
+func (this *FdfsClient) NewUploadSession(checkpointFile string, fileExtName string) (*UploadSession, error) {
+	session := this.newUploadSession(checkpointFile, fileExtName)
+	if checkpointFile == "" {
+		return session, nil
+	}
+	buf, err := os.ReadFile(checkpointFile)
+	if os.IsNotExist(err) {
+		return session, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, &session.checkpoint); err != nil {
+		return nil, fmt.Errorf("%s: %s", checkpointFile, err.Error())
+	}
+	if _, err = NewFileIdFromStr(session.checkpoint.FileId); err != nil || session.checkpoint.Offset < 0 {
+		return nil, fmt.Errorf("%s: invalid checkpoint", checkpointFile)
+	}
+	return session, nil
+}
+
+func (this *FdfsClient) newUploadSession(checkpointFile string, fileExtName string) *UploadSession {
+	return &UploadSession{
+		client:         this,
+		checkpointFile: checkpointFile,
+		checkpoint:     uploadCheckpoint{ExtName: fileExtName},
+		ChunkSize:      DEFAULT_UPLOAD_CHUNK_SIZE,
+		MaxRetries:     DEFAULT_UPLOAD_MAX_RETRIES,
+		RetryInterval:  DEFAULT_UPLOAD_RETRY_INTERVAL,
+	}
+}
+
+// FileId is the id of the appender file, it is empty until the first chunk
+// is uploaded
+func (this *UploadSession) FileId() string {
+	return this.checkpoint.FileId
+}
+
+// Offset is the number of bytes committed to the appender file
+func (this *UploadSession) Offset() int64 {
+	return this.checkpoint.Offset
+}
+
+func (this *UploadSession) Upload(input io.ReadSeeker) error {
+	return this.UploadContext(context.Background(), input)
+}
+
+// UploadContext sends input from the committed offset to its end. input must
+// be the same content every time the session is resumed.
+func (this *UploadSession) UploadContext(ctx context.Context, input io.ReadSeeker) error {
+	if this.ChunkSize <= 0 {
+		return fmt.Errorf("%w: chunk size %d", ErrInvalidArgument, this.ChunkSize)
+	}
+	if this.checkpoint.FileId != "" {
+		// a chunk may be committed after the last checkpoint was saved
+		if err := this.retry(ctx, func() error { return this.sync(ctx, math.MaxInt64) }); err != nil {
+			return err
+		}
+	}
+	if _, err := input.Seek(this.checkpoint.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, this.ChunkSize)
+	for {
+		n, err := io.ReadFull(input, chunk)
+		if err == io.EOF && this.checkpoint.FileId != "" {
+			return nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if this.checkpoint.FileId == "" {
+			err = this.create(ctx, chunk[:n])
+		} else {
+			err = this.append(ctx, chunk[:n])
+		}
+		if err != nil {
+			return err
+		}
+		if n < len(chunk) {
+			return nil
+		}
+	}
+}
+
+// Complete ends the session and removes its checkpoint file. With regular,
+// the appender file is turned into a normal file, which has a new file id.
+func (this *UploadSession) Complete(regular bool) (remoteFileId string, e error) {
+	return this.CompleteContext(context.Background(), regular)
+}
+
+func (this *UploadSession) CompleteContext(ctx context.Context, regular bool) (remoteFileId string, e error) {
+	if this.checkpoint.FileId == "" {
+		return "", fmt.Errorf("%w: nothing is uploaded", ErrInvalidArgument)
+	}
+	remoteFileId = this.checkpoint.FileId
+	if regular {
+		var err error
+		if remoteFileId, err = this.client.RegenerateAppenderFilenameContext(ctx, remoteFileId); err != nil {
+			return "", err
+		}
+	}
+	if this.checkpointFile != "" {
+		if err := os.Remove(this.checkpointFile); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return remoteFileId, nil
+}
+
+// create uploads the appender file with the first chunk
+func (this *UploadSession) create(ctx context.Context, chunk []byte) error {
+	return this.retry(ctx, func() error {
+		fileId, err := this.client.UploadAppenderByBufferContext(ctx, chunk, this.checkpoint.ExtName)
+		if err != nil {
+			return err
+		}
+		this.checkpoint.FileId = fileId
+		this.checkpoint.Offset = int64(len(chunk))
+		return this.save()
+	})
+}
+
+// append sends a chunk. A failed append may be committed in full or in part,
+// the size of the appender file tells what is left to send.
+func (this *UploadSession) append(ctx context.Context, chunk []byte) error {
+	start := this.checkpoint.Offset
+	end := start + int64(len(chunk))
+	synced := true
+	return this.retry(ctx, func() error {
+		var err error
+		if synced {
+			err = this.client.AppendByBufferContext(ctx, this.checkpoint.FileId, chunk[this.checkpoint.Offset-start:])
+		}
+		// nothing is sent again until the committed offset is known
+		serr := this.sync(ctx, end)
+		synced = serr == nil
+		if synced && this.checkpoint.Offset == end {
+			return nil
+		}
+		if err == nil {
+			err = serr
+		}
+		if err == nil {
+			err = fmt.Errorf("%w: appender file size %d after append, expect %d", ErrProtocol, this.checkpoint.Offset, end)
+		}
+		return err
+	})
+}
+
+// sync reads the committed offset from the file info, and saves it if it
+// changed. The info is read from the source storage of the file, as a replica
+// may lag behind. A size out of [offset, max] means the file is changed by
+// someone else.
+func (this *UploadSession) sync(ctx context.Context, max int64) error {
+	fid, store, err := this.client.queryUpdateStorage(ctx, this.checkpoint.FileId)
+	if err != nil {
+		return err
+	}
+	info, err := store.QueryFileInfoContext(ctx, fid.FileName)
+	if err != nil {
+		return err
+	}
+	if info.FileSize < this.checkpoint.Offset || info.FileSize > max {
+		return fmt.Errorf("%w: appender file %s has %d bytes, %d are committed", ErrModified,
+			this.checkpoint.FileId, info.FileSize, this.checkpoint.Offset)
+	}
+	if info.FileSize == this.checkpoint.Offset {
+		return nil
+	}
+	this.checkpoint.Offset = info.FileSize
+	return this.save()
+}
+
+// retry runs fn until it succeeds, up to MaxRetries more times for retryable
+// errors
+func (this *UploadSession) retry(ctx context.Context, fn func() error) error {
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || !IsRetryable(err) || retries >= this.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(this.RetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// save writes the checkpoint to a temporary file renamed over the checkpoint
+// file, so that a crash never leaves a partial checkpoint
+func (this *UploadSession) save() error {
+	if this.checkpointFile == "" {
+		return nil
+	}
+	buf, err := json.Marshal(&this.checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(this.checkpointFile), filepath.Base(this.checkpointFile)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.checkpointFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+// failingReader fails once limit bytes are read, like a crash in the middle of
+// an upload
+type failingReader struct {
+	*bytes.Reader
+	limit int64
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	offset := r.Size() - int64(r.Len())
+	if offset >= r.limit {
+		return 0, errors.New("input failed")
+	}
+	if int64(len(p)) > r.limit-offset {
+		p = p[:r.limit-offset]
+	}
+	return r.Reader.Read(p)
+}
+
+func TestUploadSession(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+	data := make([]byte, 10*1024+100)
+	rand.Read(data)
+	checkpointFile := filepath.Join(t.TempDir(), "upload.json")
+
+	session, err := fdfsClient.NewUploadSession(checkpointFile, "bin")
+	if err != nil {
+		t.Fatal("NewUploadSession error:", err)
+	}
+	session.ChunkSize = 1024
+	err = session.Upload(&failingReader{Reader: bytes.NewReader(data), limit: 3*1024 + 10})
+	if err == nil {
+		t.Fatal("Upload of a failing input succeeds")
+	}
+	if session.FileId() == "" || session.Offset() != 3*1024 {
+		t.Fatalf("session file id %q, offset %d, expect 3 chunks committed", session.FileId(), session.Offset())
+	}
+
+	// resumed from the checkpoint, the next append is dropped once
+	for _, s := range cluster.Storages {
+		s.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_APPEND_FILE, Drop: true, Times: 1})
+		defer s.ClearFaults()
+	}
+	resumed, err := fdfsClient.NewUploadSession(checkpointFile, "bin")
+	if err != nil {
+		t.Fatal("NewUploadSession error:", err)
+	}
+	if resumed.FileId() != session.FileId() || resumed.Offset() != session.Offset() {
+		t.Fatalf("resumed session file id %q, offset %d, expect %q, %d", resumed.FileId(), resumed.Offset(),
+			session.FileId(), session.Offset())
+	}
+	resumed.ChunkSize = 1024
+	resumed.RetryInterval = 0
+	if err = resumed.Upload(bytes.NewReader(data)); err != nil {
+		t.Fatal("Upload error:", err)
+	}
+	if resumed.Offset() != int64(len(data)) {
+		t.Fatalf("session offset %d, expect %d", resumed.Offset(), len(data))
+	}
+
+	remoteFileId, err := resumed.Complete(true)
+	if err != nil {
+		t.Fatal("Complete error:", err)
+	}
+	defer fdfsClient.DeleteFile(remoteFileId)
+	if _, err = os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Fatal("checkpoint file is not removed")
+	}
+	fid, _ := NewFileIdFromStr(remoteFileId)
+	if info, err := fid.Decode(); err != nil || info.FileType != FDFS_FILE_TYPE_NORMAL {
+		t.Fatalf("completed file %s is not a normal file", remoteFileId)
+	}
+	if err = fdfsClient.AppendByBuffer(remoteFileId, []byte("1")); err == nil {
+		t.Fatal("completed file is still an appender file")
+	}
+	buf := &bytes.Buffer{}
+	if _, err = fdfsClient.DownloadEx(remoteFileId, buf, 0, 0); err != nil {
+		t.Fatal("DownloadEx error:", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("uploaded content is different")
+	}
+	if _, err = fdfsClient.DownloadEx(session.FileId(), io.Discard, 0, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("appender file download returns %v, expect ErrNotFound", err)
+	}
+}
+
+func TestUploadSessionModified(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+	data := make([]byte, 4*1024)
+	rand.Read(data)
+	checkpointFile := filepath.Join(t.TempDir(), "upload.json")
+
+	session, err := fdfsClient.NewUploadSession(checkpointFile, "bin")
+	if err != nil {
+		t.Fatal("NewUploadSession error:", err)
+	}
+	session.ChunkSize = 1024
+	if err = session.Upload(&failingReader{Reader: bytes.NewReader(data), limit: 1024 + 10}); err == nil {
+		t.Fatal("Upload of a failing input succeeds")
+	}
+	defer fdfsClient.DeleteFile(session.FileId())
+	// the committed chunk is truncated by someone else
+	if err = fdfsClient.TruncateFile(session.FileId(), 10); err != nil {
+		t.Fatal("TruncateFile error:", err)
+	}
+
+	// the committed offset is read from the source storage, not a replica
+	tracker := cluster.Tracker
+	fetches := tracker.Requests(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE)
+	updates := tracker.Requests(TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE)
+	resumed, err := fdfsClient.NewUploadSession(checkpointFile, "bin")
+	if err != nil {
+		t.Fatal("NewUploadSession error:", err)
+	}
+	resumed.ChunkSize = 1024
+	resumed.RetryInterval = 0
+	if err = resumed.Upload(bytes.NewReader(data)); !errors.Is(err, ErrModified) || IsRetryable(err) {
+		t.Fatalf("Upload of a modified file returns %v, expect ErrModified", err)
+	}
+	if n := tracker.Requests(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE); n != fetches {
+		t.Fatalf("%d fetch queries, expect none", n-fetches)
+	}
+	if n := tracker.Requests(TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE); n == updates {
+		t.Fatal("no update query")
+	}
+}
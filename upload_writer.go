@@ -0,0 +1,109 @@
+package fdfs_client
+
+import (
+	"context"
+	"os"
+)
+
+// UploadWriter uploads data of unknown length. Data up to ChunkSize bytes is
+// buffered and sent in a single upload on Close, larger data goes to an
+// appender file in chunks of ChunkSize bytes.
+type UploadWriter struct {
+	ctx     context.Context
+	session *UploadSession
+	buf     []byte
+	fileId  string
+	err     error
+	closed  bool
+	// the ChunkSize of the first Write
+	chunkSize int
+
+	// ChunkSize must be set before the first Write, later changes are
+	// ignored. It defaults to DEFAULT_UPLOAD_CHUNK_SIZE.
+	ChunkSize int
+	// RegularFile turns the appender file into a normal file on Close, the
+	// storages must be V6.02 or later. Small uploads are always normal files.
+	RegularFile bool
+}
+
+func (this *FdfsClient) NewUploadWriter(fileExtName string) *UploadWriter {
+	return this.NewUploadWriterContext(context.Background(), fileExtName)
+}
+
+// NewUploadWriterContext returns a writer whose uploads use ctx
+func (this *FdfsClient) NewUploadWriterContext(ctx context.Context, fileExtName string) *UploadWriter {
+	return &UploadWriter{
+		ctx:       ctx,
+		session:   this.newUploadSession("", fileExtName),
+		ChunkSize: DEFAULT_UPLOAD_CHUNK_SIZE,
+	}
+}
+
+func (this *UploadWriter) Write(p []byte) (n int, err error) {
+	if this.closed {
+		return 0, os.ErrClosed
+	}
+	if this.err != nil {
+		return 0, this.err
+	}
+	if this.buf == nil {
+		this.chunkSize = this.ChunkSize
+		if this.chunkSize <= 0 {
+			this.chunkSize = DEFAULT_UPLOAD_CHUNK_SIZE
+		}
+		this.buf = make([]byte, 0, this.chunkSize)
+	}
+	for len(p) > 0 {
+		m := copy(this.buf[len(this.buf):this.chunkSize], p)
+		this.buf = this.buf[:len(this.buf)+m]
+		p = p[m:]
+		n += m
+		// a full buffer is sent only when more data comes, so that data of
+		// exactly ChunkSize bytes is a single upload
+		if len(this.buf) == this.chunkSize && len(p) > 0 {
+			if this.err = this.flush(); this.err != nil {
+				return n, this.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (this *UploadWriter) flush() error {
+	var err error
+	if this.session.FileId() == "" {
+		err = this.session.create(this.ctx, this.buf)
+	} else {
+		err = this.session.append(this.ctx, this.buf)
+	}
+	this.buf = this.buf[:0]
+	return err
+}
+
+// Close completes the upload. After a failure, the partial appender file is
+// deleted and the error is returned again.
+func (this *UploadWriter) Close() error {
+	if this.closed {
+		return os.ErrClosed
+	}
+	this.closed = true
+	client := this.session.client
+	if this.err == nil {
+		if this.session.FileId() == "" {
+			this.fileId, this.err = client.UploadByBufferContext(this.ctx, this.buf, this.session.checkpoint.ExtName)
+		} else if this.err = this.flush(); this.err == nil {
+			this.fileId, this.err = this.session.CompleteContext(this.ctx, this.RegularFile)
+		}
+	}
+	if this.err != nil && this.session.FileId() != "" {
+		client.DeleteFileContext(context.Background(), this.session.FileId())
+	}
+	this.buf = nil
+	return this.err
+}
+
+// FileId returns the id of the uploaded file, it is empty until Close
+// succeeds
+func (this *UploadWriter) FileId() string {
+	return this.fileId
+}
@@ -0,0 +1,97 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/tnextday/fdfs_client/fdfstest"
+)
+
+func TestUploadWriter(t *testing.T) {
+	fdfsClient := FdfsClient{ConnPool: connPool}
+	data := make([]byte, 50*1024)
+	rand.Read(data)
+
+	tests := []struct {
+		size        int
+		regularFile bool
+		fileType    FileType
+	}{
+		{0, false, FDFS_FILE_TYPE_NORMAL},
+		{1000, false, FDFS_FILE_TYPE_NORMAL},
+		{1001, false, FDFS_FILE_TYPE_APPENDER},
+		{len(data), true, FDFS_FILE_TYPE_NORMAL},
+	}
+	for _, tt := range tests {
+		w := fdfsClient.NewUploadWriter("bin")
+		w.ChunkSize = 1000
+		w.RegularFile = tt.regularFile
+		// writes of random sizes
+		for p := data[:tt.size]; len(p) > 0; {
+			n := rand.Intn(3000) + 1
+			if n > len(p) {
+				n = len(p)
+			}
+			w.Write(p[:n])
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close of %d bytes error: %v", tt.size, err)
+		}
+		fid, _ := NewFileIdFromStr(w.FileId())
+		if info, err := fid.Decode(); err != nil || info.FileType != tt.fileType {
+			t.Fatalf("upload of %d bytes is not a %s file", tt.size, tt.fileType)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := fdfsClient.DownloadEx(w.FileId(), buf, 0, 0); err != nil || !bytes.Equal(buf.Bytes(), data[:tt.size]) {
+			t.Fatalf("upload of %d bytes has a different content, %v", tt.size, err)
+		}
+		fdfsClient.DeleteFile(w.FileId())
+	}
+
+	w := fdfsClient.NewUploadWriter("gz")
+	w.ChunkSize = 1000
+	zw := gzip.NewWriter(w)
+	zw.Write(data[:100])
+	// ChunkSize is latched by the first Write
+	w.ChunkSize = 4000
+	zw.Write(data[100:])
+	zw.Close()
+	if err := w.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+	if _, err := w.Write(data); err != os.ErrClosed {
+		t.Fatalf("Write after Close returns %v, expect os.ErrClosed", err)
+	}
+	buf := &bytes.Buffer{}
+	fdfsClient.DownloadEx(w.FileId(), buf, 0, 0)
+	zr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal("gzip.NewReader error:", err)
+	}
+	unzipped := &bytes.Buffer{}
+	if _, err = unzipped.ReadFrom(zr); err != nil || !bytes.Equal(unzipped.Bytes(), data) {
+		t.Fatal("gzip content is different", err)
+	}
+	fdfsClient.DeleteFile(w.FileId())
+
+	// the partial appender file is deleted after a failure
+	for _, s := range cluster.Storages {
+		s.Inject(fdfstest.Fault{Cmd: STORAGE_PROTO_CMD_APPEND_FILE, Status: fdfstest.ENOSPC})
+		defer s.ClearFaults()
+	}
+	w = fdfsClient.NewUploadWriter("bin")
+	w.ChunkSize = 1000
+	w.session.RetryInterval = 0
+	w.Write(data[:3000])
+	if err = w.Close(); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Close returns %v, expect ErrNoSpace", err)
+	}
+	if _, err = fdfsClient.QueryFileInfo(w.session.FileId()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("partial appender file is not deleted, QueryFileInfo returns %v", err)
+	}
+}
@@ -1,32 +1,18 @@
 package fdfs_client
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
 	"strings"
 )
 
-type Errno struct {
-	status int
-}
-
-func (e Errno) Error() string {
-	errmsg := fmt.Sprintf("errno [%d] ", e.status)
-	switch e.status {
-	case 17:
-		errmsg += "File Exist"
-	case 22:
-		errmsg += "Argument Invlid"
-	}
-	return errmsg
-}
-
 func readCstr(buff io.Reader, length int) (string, error) {
 	str := make([]byte, length)
 	n, err := buff.Read(str)
 	if err != nil || n != len(str) {
-		return "", Errno{255}
+		return "", fmt.Errorf("%w: string of %d bytes is truncated", ErrProtocol, length)
 	}
 
 	for i, v := range str {
@@ -50,7 +36,7 @@ func TrimCStr(cstr []byte) string {
 func splitRemoteFileId(remoteFileId string) (groupName, remoteFilename string, e error) {
 	parts := strings.SplitN(remoteFileId, "/", 2)
 	if len(parts) != 2 {
-		return "", "", errors.New("error remoteFileId")
+		return "", "", fmt.Errorf("%w: invalid file id %q", ErrInvalidArgument, remoteFileId)
 	}
 	return parts[0], parts[1], nil
 }
@@ -62,3 +48,16 @@ func getFileExt(filename string) string {
 	}
 	return ""
 }
+
+// splitHostPort splits a "host:port" address, the port must be a valid tcp port
+func splitHostPort(addr string) (host string, port int, e error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return "", 0, fmt.Errorf("%w: invalid port in address %s", ErrInvalidArgument, addr)
+	}
+	return host, port, nil
+}